@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage:
+  localstackmount [mount] [flags]              mount LocalStack S3 (run "localstackmount mount -help" for flags)
+  localstackmount <source> <mountpoint> [-o opt1,opt2]
+                                               mount helper form for mount -t fuse.localstackmount and /etc/fstab
+  localstackmount unmount [--lazy|--force] [mountpoint]
+  localstackmount status [--json]
+`
+
+// unmountWait はアンマウント後にマウントしたプロセスの終了を待つ時間
+const unmountWait = 5 * time.Second
+
+// run はサブコマンドを実行する。サブコマンドを省略した場合はmountとみなす
+func run(name string, args []string) error {
+	// デーモンとして起動し直す場合、os.Executableがmount.*のシンボリックリンクを返すことがあるためmountサブコマンドを優先する
+	if strings.HasPrefix(filepath.Base(name), "mount.") && (len(args) == 0 || args[0] != "mount") {
+		return runHelper(args)
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runMount(args)
+	}
+
+	switch args[0] {
+	case "mount":
+		return runMount(args[1:])
+	case "unmount", "umount":
+		return runUnmount(args[1:])
+	case "status":
+		return runStatus(args[1:])
+	case "help":
+		fmt.Print(usage)
+		return nil
+	}
+	if isHelper(args) {
+		return runHelper(args)
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], strings.TrimSuffix(usage, "\n"))
+}
+
+func runMount(args []string) error {
+	c, err := parseInput(args)
+	if err != nil {
+		return err
+	}
+	if c.Daemon {
+		return daemonize(c, args)
+	}
+	return mount(c)
+}
+
+func runHelper(args []string) error {
+	flags, err := helperArgs(args)
+	if err != nil {
+		return err
+	}
+	return runMount(flags)
+}
+
+func runUnmount(args []string) error {
+	set := flag.NewFlagSet("localstackmount unmount", flag.ContinueOnError)
+	lazy := set.Bool("lazy", false, "detach now and finish unmounting when the mount is no longer busy")
+	force := set.Bool("force", false, "unmount even if busy and stop the mount process. writes to files still open may be lost")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	var mountpoint string
+	switch set.NArg() {
+	case 0:
+		// マウントが1つだけならマウントポイントを省略できる
+		states, err := readStates()
+		if err != nil {
+			return err
+		}
+		if len(states) != 1 {
+			return fmt.Errorf("specify a mountpoint: %d active mounts", len(states))
+		}
+		mountpoint = states[0].Mountpoint
+	case 1:
+		abs, err := filepath.Abs(set.Arg(0))
+		if err != nil {
+			return err
+		}
+		mountpoint = abs
+	default:
+		return fmt.Errorf("unexpected arguments: %v", set.Args()[1:])
+	}
+
+	st, found, err := findState(mountpoint)
+	if err != nil {
+		return err
+	}
+
+	if err := unmountDir(mountpoint, *lazy, *force); err != nil {
+		if errors.Is(err, syscall.EBUSY) {
+			return fmt.Errorf("unmount %s: %w (close the files in use or retry with --lazy or --force)", mountpoint, err)
+		}
+		return fmt.Errorf("unmount %s: %w", mountpoint, err)
+	}
+
+	if found {
+		if *lazy && !*force {
+			// 使用中のファイルが閉じられるとプロセスは自分で終了する
+			fmt.Println("detached:", mountpoint)
+			return nil
+		}
+		wait := unmountWait
+		if *force {
+			wait = time.Second
+		}
+		if !waitExit(st, wait) {
+			if !*force {
+				return fmt.Errorf("unmounted %s but process %d is still running", mountpoint, st.PID)
+			}
+			if err := stopProcess(st); err != nil {
+				return err
+			}
+			removeState(mountpoint)
+		}
+	}
+	fmt.Println("unmounted:", mountpoint)
+	return nil
+}
+
+// stopProcess は遅延解除したマウントのプロセスを止める。SIGTERMで開いているファイルの書き込みをアップロードさせ、
+// それでも終了しなければSIGKILLする。その場合はアップロードされていない書き込みが失われる
+func stopProcess(st State) error {
+	if err := syscall.Kill(st.PID, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("terminate process %d: %w", st.PID, err)
+	}
+	if waitExit(st, unmountWait) {
+		return nil
+	}
+	if err := syscall.Kill(st.PID, syscall.SIGKILL); err != nil {
+		return fmt.Errorf("kill process %d: %w", st.PID, err)
+	}
+	fmt.Fprintf(os.Stderr, "killed process %d: writes that were not uploaded are lost\n", st.PID)
+	return nil
+}
+
+func waitExit(st State, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for st.alive() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+func runStatus(args []string) error {
+	set := flag.NewFlagSet("localstackmount status", flag.ContinueOnError)
+	asJSON := set.Bool("json", false, "print as JSON")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	states, err := readStates()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if states == nil {
+			states = []State{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(states)
+	}
+
+	if len(states) == 0 {
+		fmt.Println("no active mounts")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MOUNTPOINT\tENDPOINT\tROOT\tPID\tUPTIME\tLISTS\tDIRS\tATTRS\tNEGATIVES\tBLOCKS\tBLOCK BYTES")
+	for _, st := range states {
+		root := st.Root
+		if root == "" {
+			root = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			st.Mountpoint, st.Endpoint, root, st.PID, time.Since(st.Started).Round(time.Second),
+			st.Cache.Lists, st.Cache.Dirs, st.Cache.Attrs, st.Cache.Negatives, st.Cache.Blocks, st.Cache.BlockBytes)
+	}
+	return w.Flush()
+}
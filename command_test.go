@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// startProcess はnameを起動し、終了したらすぐに回収してゾンビとして残らないようにする
+func startProcess(t *testing.T, name string, args ...string) (State, <-chan struct{}) {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		<-exited
+	})
+	return State{PID: cmd.Process.Pid}, exited
+}
+
+func TestWaitExit(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		timeout time.Duration
+		want    bool
+	}{
+		{name: "exits in time", args: []string{"0.2"}, timeout: 5 * time.Second, want: true},
+		{name: "still running", args: []string{"60"}, timeout: 300 * time.Millisecond, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, _ := startProcess(t, "sleep", tt.args...)
+			if got := waitExit(st, tt.timeout); got != tt.want {
+				t.Errorf("waitExit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStopProcess(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "terminate", args: []string{"-c", "exec sleep 60"}},
+		// SIGTERMを無視するプロセスはunmountWaitの後にSIGKILLする
+		{name: "kill", args: []string{"-c", `trap "" TERM; exec sleep 60`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, exited := startProcess(t, "sh", tt.args...)
+			time.Sleep(100 * time.Millisecond) // trapを設定するまで待つ
+
+			if err := stopProcess(st); err != nil {
+				t.Fatalf("stopProcess() error = %v", err)
+			}
+			select {
+			case <-exited:
+			case <-time.After(time.Second):
+				t.Errorf("process %d is still running after stopProcess()", st.PID)
+			}
+		})
+	}
+}
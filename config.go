@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/ma91n/localstackmount/fs"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultProfile は設定ファイルでdefaultもprofileの指定も無い場合に使うプロファイル
+const defaultProfile = "default"
+
+// Config は設定ファイル。プロファイルごとにInputの項目を上書きする
+//
+//	default: local
+//	profiles:
+//	  local:
+//	    endpoint: http://localhost:4566
+//	    dir: ~/mount/localstack
+//	  ci:
+//	    endpoint: http://localstack:4566
+//	    bucket_cache_ttl:
+//	      fixtures: {list: 1h, attr: 1h, negative: 1h}
+type Config struct {
+	Default  string               `yaml:"default"`
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+}
+
+// parseInput は既定値、設定ファイル、環境変数、コマンドライン引数の順に上書きしてInputを作る
+func parseInput(args []string) (Input, error) {
+	c := defaultInput()
+
+	// 設定ファイルの場所とプロファイルを知るために一度パースする。繰り返し指定できるフラグが二重に追加されないように別のInputに読み込む
+	var configPath, profile string
+	scratch := defaultInput()
+	set := newFlagSet(&scratch, &configPath, &profile)
+	if err := set.Parse(args); err != nil {
+		return Input{}, err
+	}
+
+	if err := loadConfig(&c, configPath, profile); err != nil {
+		return Input{}, err
+	}
+
+	if os.Getenv("AWS_REGION") != "" {
+		c.Region = os.Getenv("AWS_REGION")
+	}
+
+	if os.Getenv("LOCALSTACK_ENDPOINT") != "" {
+		c.LocalStackEndpoint = os.Getenv("LOCALSTACK_ENDPOINT")
+	}
+
+	// コマンドライン引数を優先するため、設定ファイルの読み込み後にもう一度パースする
+	if err := newFlagSet(&c, &configPath, &profile).Parse(args); err != nil {
+		return Input{}, err
+	}
+	if set.NArg() > 0 {
+		return Input{}, fmt.Errorf("unexpected arguments: %v", set.Args())
+	}
+	return c, nil
+}
+
+func newFlagSet(c *Input, configPath, profile *string) *flag.FlagSet {
+	set := flag.NewFlagSet("localstackmount", flag.ContinueOnError)
+
+	set.StringVar(configPath, "config", "", "config file (default "+defaultConfigPath()+")")
+	set.StringVar(profile, "profile", "", "profile name in the config file")
+
+	set.StringVar(&c.Region, "region", c.Region, "AWS region (env AWS_REGION)")
+	set.StringVar(&c.LocalStackEndpoint, "endpoint", c.LocalStackEndpoint, "LocalStack endpoint (env LOCALSTACK_ENDPOINT)")
+	set.StringVar(&c.Root, "root", c.Root, "mount only bucket[:prefix] instead of all buckets")
+	set.StringVar(&c.Dir, "dir", c.Dir, "mount point")
+	set.BoolVar(&c.Debug, "debug", c.Debug, "print FUSE debug logs")
+	set.Int64Var(&c.ReadAhead, "read-ahead", c.ReadAhead, "bytes to read ahead on sequential reads")
+	set.Int64Var(&c.MultipartThreshold, "multipart-threshold", c.MultipartThreshold, "switch to multipart upload above this size in bytes, 0 to disable")
+	set.Int64Var(&c.PartSize, "part-size", c.PartSize, "multipart upload part size in bytes")
+	set.StringVar(&c.JournalDir, "journal-dir", c.JournalDir, "directory for the rename journal, empty to disable")
+	set.StringVar(&c.RenameRecovery, "rename-recovery", c.RenameRecovery, "how to recover interrupted renames: forward or rollback")
+
+	set.Var(contentTypesFlag{c}, "content-type", "Content-Type for an extension, e.g. .js=application/javascript (repeatable)")
+	set.BoolVar(&c.PreserveContentType, "preserve-content-type", c.PreserveContentType, "keep the Content-Type of overwritten objects")
+
+	set.DurationVar(&c.ListCacheTTL, "list-cache-ttl", c.ListCacheTTL, "TTL of cached listings, 0 to disable")
+	set.DurationVar(&c.AttrCacheTTL, "attr-cache-ttl", c.AttrCacheTTL, "TTL of cached attributes, 0 to disable")
+	set.DurationVar(&c.NegativeCacheTTL, "negative-cache-ttl", c.NegativeCacheTTL, "TTL of cached lookup misses, 0 to disable")
+	set.Var(bucketCacheTTLFlag{c}, "bucket-cache-ttl", "cache TTL for a bucket, e.g. fixtures=1h or output=0 (repeatable)")
+
+	set.StringVar(&c.BlockCacheDir, "block-cache-dir", c.BlockCacheDir, "directory for the object block cache, empty to disable")
+	set.Int64Var(&c.BlockSize, "block-size", c.BlockSize, "block size of the object block cache in bytes")
+	set.Int64Var(&c.BlockCacheSize, "block-cache-size", c.BlockCacheSize, "size limit of the object block cache in bytes per mount process, 0 for unlimited")
+
+	set.DurationVar(&c.EntryTimeout, "entry-timeout", c.EntryTimeout, "kernel entry cache timeout")
+	set.DurationVar(&c.AttrTimeout, "attr-timeout", c.AttrTimeout, "kernel attribute cache timeout")
+	set.DurationVar(&c.NegativeTimeout, "negative-timeout", c.NegativeTimeout, "kernel negative entry cache timeout")
+	set.Var(ownerFlag{c}, "owner", "uid:gid for files without an owner")
+	set.BoolVar(&c.KeepCache, "keep-cache", c.KeepCache, "keep the kernel page cache while the ETag is unchanged")
+	set.BoolVar(&c.ClientInodes, "client-inodes", c.ClientInodes, "use inode numbers that stay the same across renames, false to let go-fuse assign them")
+
+	set.BoolVar(&c.AllowOther, "allow-other", c.AllowOther, "allow other users to access the mount (FUSE allow_other)")
+	set.BoolVar(&c.NonEmpty, "nonempty", c.NonEmpty, "allow mounting over a non-empty directory (FUSE nonempty)")
+	set.Var(mountOptionsFlag{c}, "mount-options", "comma separated FUSE mount options such as ro,noexec (repeatable)")
+
+	set.BoolVar(&c.Daemon, "daemon", c.Daemon, "run in the background and exit once the mount is ready")
+	set.IntVar(&c.ReadyFD, "ready-fd", c.ReadyFD, "write READY=1 (or ERROR=<reason>) to this file descriptor when the mount is ready")
+	return set
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "localstackmount", "config.yaml")
+}
+
+// decodeStrict は未知のキーをエラーにしてYAMLを読み込む
+func decodeStrict(b []byte, v any) error {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// loadConfig は設定ファイルのプロファイルでcを上書きする。パスの指定が無く、既定の場所にも無ければ何もしない
+func loadConfig(c *Input, configPath, profile string) error {
+	explicit := configPath != ""
+	if !explicit {
+		configPath = defaultConfigPath()
+	}
+
+	b, err := os.ReadFile(configPath)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			if profile != "" {
+				return fmt.Errorf("profile %q is specified but config file %s does not exist", profile, configPath)
+			}
+			return nil
+		}
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	// 書き間違えた項目が黙って無視されないよう、未知のキーはエラーにする
+	var config Config
+	if err := decodeStrict(b, &config); err != nil {
+		return fmt.Errorf("parse config %s: %w", configPath, err)
+	}
+	if len(config.Profiles) == 0 {
+		return fmt.Errorf("config %s has no profiles", configPath)
+	}
+
+	if profile == "" {
+		profile = config.Default
+	}
+	if profile == "" {
+		profile = defaultProfile
+	}
+
+	node, ok := config.Profiles[profile]
+	if !ok {
+		names := make([]string, 0, len(config.Profiles))
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("profile %q is not found in %s: %v", profile, configPath, names)
+	}
+
+	// 指定された項目のみ既定値を上書きする。yaml.NodeのDecodeはKnownFieldsを指定できないため、書き出してから読み直す
+	pb, err := yaml.Marshal(&node)
+	if err != nil {
+		return fmt.Errorf("parse profile %q: %w", profile, err)
+	}
+	if err := decodeStrict(pb, c); err != nil {
+		return fmt.Errorf("parse profile %q: %w", profile, err)
+	}
+	c.Dir = expandHome(c.Dir)
+	c.JournalDir = expandHome(c.JournalDir)
+	c.BlockCacheDir = expandHome(c.BlockCacheDir)
+	return nil
+}
+
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, strings.TrimPrefix(p, "~"))
+}
+
+type contentTypesFlag struct{ c *Input }
+
+func (f contentTypesFlag) String() string {
+	if f.c == nil {
+		return ""
+	}
+	return fmt.Sprint(f.c.ContentTypes)
+}
+
+func (f contentTypesFlag) Set(v string) error {
+	ext, contentType, ok := strings.Cut(v, "=")
+	if !ok || !strings.HasPrefix(ext, ".") || contentType == "" {
+		return fmt.Errorf("expected .ext=content/type: %q", v)
+	}
+	if f.c.ContentTypes == nil {
+		f.c.ContentTypes = map[string]string{}
+	}
+	f.c.ContentTypes[strings.ToLower(ext)] = contentType
+	return nil
+}
+
+type bucketCacheTTLFlag struct{ c *Input }
+
+func (f bucketCacheTTLFlag) String() string {
+	if f.c == nil {
+		return ""
+	}
+	return fmt.Sprint(f.c.BucketCacheTTL)
+}
+
+func (f bucketCacheTTLFlag) Set(v string) error {
+	bucket, ttl, ok := strings.Cut(v, "=")
+	if !ok || bucket == "" {
+		return fmt.Errorf("expected bucket=duration: %q", v)
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return err
+	}
+	if f.c.BucketCacheTTL == nil {
+		f.c.BucketCacheTTL = map[string]fs.CacheTTL{}
+	}
+	f.c.BucketCacheTTL[bucket] = fs.CacheTTL{List: d, Attr: d, Negative: d}
+	return nil
+}
+
+type mountOptionsFlag struct{ c *Input }
+
+func (f mountOptionsFlag) String() string {
+	if f.c == nil {
+		return ""
+	}
+	return strings.Join(f.c.MountOptions, ",")
+}
+
+func (f mountOptionsFlag) Set(v string) error {
+	for _, o := range strings.Split(v, ",") {
+		if o != "" {
+			f.c.MountOptions = append(f.c.MountOptions, o)
+		}
+	}
+	return nil
+}
+
+type ownerFlag struct{ c *Input }
+
+func (f ownerFlag) String() string {
+	if f.c == nil || f.c.Owner == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", f.c.Owner.Uid, f.c.Owner.Gid)
+}
+
+func (f ownerFlag) Set(v string) error {
+	uid, gid, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("expected uid:gid: %q", v)
+	}
+	u, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("parse uid: %w", err)
+	}
+	g, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("parse gid: %w", err)
+	}
+	f.c.Owner = &fuse.Owner{Uid: uint32(u), Gid: uint32(g)}
+	return nil
+}
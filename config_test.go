@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testConfig = `
+default: local
+profiles:
+  local:
+    region: us-east-1
+    endpoint: http://localhost:4566
+  ci:
+    region: us-west-2
+    endpoint: http://localstack:4566
+`
+
+func TestParseInput(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(name, body string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	config := writeConfig("config.yaml", testConfig)
+	noDefault := writeConfig("no-default.yaml", "profiles:\n  ci:\n    region: us-west-2\n")
+	defaultName := writeConfig("default-name.yaml", "profiles:\n  default:\n    region: eu-west-1\n")
+	noProfiles := writeConfig("no-profiles.yaml", "region: us-west-2\n")
+	empty := writeConfig("empty.yaml", "")
+	unknownKey := writeConfig("unknown-key.yaml", "profiles:\n  default:\n    regoin: us-west-2\n")
+	unknownTop := writeConfig("unknown-top.yaml", "defualt: ci\nprofiles:\n  default:\n    region: us-west-2\n")
+
+	tests := []struct {
+		name         string
+		args         []string
+		env          map[string]string
+		wantRegion   string
+		wantEndpoint string
+		wantErr      bool
+	}{
+		{
+			name:         "default profile of the config file",
+			args:         []string{"-config", config},
+			wantRegion:   "us-east-1",
+			wantEndpoint: "http://localhost:4566",
+		},
+		{
+			name:         "profile flag",
+			args:         []string{"-config", config, "-profile", "ci"},
+			wantRegion:   "us-west-2",
+			wantEndpoint: "http://localstack:4566",
+		},
+		{
+			name:         "env overrides the config file",
+			args:         []string{"-config", config},
+			env:          map[string]string{"AWS_REGION": "ap-northeast-1", "LOCALSTACK_ENDPOINT": "http://env:4566"},
+			wantRegion:   "ap-northeast-1",
+			wantEndpoint: "http://env:4566",
+		},
+		{
+			name:         "flags override env",
+			args:         []string{"-config", config, "-region", "eu-central-1", "-endpoint", "http://flag:4566"},
+			env:          map[string]string{"AWS_REGION": "ap-northeast-1", "LOCALSTACK_ENDPOINT": "http://env:4566"},
+			wantRegion:   "eu-central-1",
+			wantEndpoint: "http://flag:4566",
+		},
+		{
+			name:         "profile named default",
+			args:         []string{"-config", defaultName},
+			wantRegion:   "eu-west-1",
+			wantEndpoint: localStackEndpoint,
+		},
+		{
+			name:    "profiles without a default",
+			args:    []string{"-config", noDefault},
+			wantErr: true,
+		},
+		{
+			name:    "config file without profiles",
+			args:    []string{"-config", noProfiles},
+			wantErr: true,
+		},
+		{
+			name:    "empty config file",
+			args:    []string{"-config", empty},
+			wantErr: true,
+		},
+		{
+			name:    "unknown key in a profile",
+			args:    []string{"-config", unknownKey},
+			wantErr: true,
+		},
+		{
+			name:    "unknown top-level key",
+			args:    []string{"-config", unknownTop},
+			wantErr: true,
+		},
+		{
+			name:    "unknown profile",
+			args:    []string{"-config", config, "-profile", "prod"},
+			wantErr: true,
+		},
+		{
+			name:    "missing config file",
+			args:    []string{"-config", filepath.Join(dir, "missing.yaml")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_REGION", "")
+			t.Setenv("LOCALSTACK_ENDPOINT", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			got, err := parseInput(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseInput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Region != tt.wantRegion {
+				t.Errorf("Region = %q, want %q", got.Region, tt.wantRegion)
+			}
+			if got.LocalStackEndpoint != tt.wantEndpoint {
+				t.Errorf("LocalStackEndpoint = %q, want %q", got.LocalStackEndpoint, tt.wantEndpoint)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// readyFD はデーモンの子プロセスにマウントの完了を通知させるファイルディスクリプタ(ExtraFilesの先頭)
+const readyFD = 3
+
+// daemonize は自身をバックグラウンドで起動し直し、マウントが完了するか失敗するまで待つ。
+// Goはforkできないため、同じ引数に--daemon=falseと--ready-fdを加えて新しいセッションで実行する
+func daemonize(c Input, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find executable: %w", err)
+	}
+	abs, err := filepath.Abs(c.Dir)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	logFile, err := os.OpenFile(logPath(abs), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	defer logFile.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create ready pipe: %w", err)
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, append([]string{"mount"}, append(args, "--daemon=false", fmt.Sprintf("--ready-fd=%d", readyFD))...)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true} // 端末を閉じても終了しないように
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("start daemon: %w", err)
+	}
+	w.Close() // 子プロセスが終了した場合にEOFになるように親の書き込み側を閉じる
+
+	line, _ := bufio.NewReader(r).ReadString('\n')
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "READY=1":
+		fmt.Printf("mount start: %s (pid %d, log %s)\n", abs, cmd.Process.Pid, logPath(abs))
+		_ = cmd.Process.Release()
+		return nil
+	case strings.HasPrefix(line, "ERROR="):
+		_ = cmd.Wait()
+		return errors.New(strings.TrimPrefix(line, "ERROR="))
+	}
+	_ = cmd.Wait()
+	return fmt.Errorf("daemon exited before mounting (%s), see %s", cmd.ProcessState, logPath(abs))
+}
+
+// notifier はマウントの完了や失敗を--ready-fdとsystemd(NOTIFY_SOCKET)に通知する
+type notifier struct {
+	ready *os.File
+}
+
+func newNotifier(fd int) *notifier {
+	n := &notifier{}
+	if fd > 0 {
+		n.ready = os.NewFile(uintptr(fd), "ready-fd")
+	}
+	return n
+}
+
+// Ready はマウントが完了したことを通知する。通知できなかった場合は起動した側が失敗とみなすため、エラーを返す
+func (n *notifier) Ready() error {
+	if err := n.write("READY=1"); err != nil {
+		return fmt.Errorf("ready-fd: %w", err)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	return nil
+}
+
+// Fail はマウントに失敗したことを通知する。Readyの後は何もしない
+func (n *notifier) Fail(err error) {
+	_ = n.write("ERROR=" + strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+// Stopping はアンマウントを始めたことをsystemdに通知する
+func (n *notifier) Stopping() {
+	_ = sdNotify("STOPPING=1")
+}
+
+func (n *notifier) write(msg string) error {
+	if n.ready == nil {
+		return nil
+	}
+	_, err := fmt.Fprintln(n.ready, msg)
+	if cerr := n.ready.Close(); err == nil {
+		err = cerr
+	}
+	n.ready = nil
+	return err
+}
+
+// sdNotify はsystemdのType=notifyのサービスとして起動された場合に状態を通知する
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // 抽象名前空間のソケット
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// readyPipe は--ready-fdとして渡すファイルディスクリプタと、その読み込み側を返す
+func readyPipe(t *testing.T) (int, *os.File) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	// notifierが閉じるため、wとは別のファイルディスクリプタにする
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+	return fd, r
+}
+
+func TestNotifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		notify func(n *notifier) error
+		want   string
+	}{
+		{
+			name:   "ready",
+			notify: (*notifier).Ready,
+			want:   "READY=1\n",
+		},
+		{
+			name: "fail",
+			notify: func(n *notifier) error {
+				n.Fail(errors.New("wait mount:\nno such device"))
+				return nil
+			},
+			want: "ERROR=wait mount: no such device\n",
+		},
+		{
+			// Readyの後の失敗は通知しない
+			name: "fail after ready",
+			notify: func(n *notifier) error {
+				if err := n.Ready(); err != nil {
+					return err
+				}
+				n.Fail(errors.New("serve"))
+				return nil
+			},
+			want: "READY=1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NOTIFY_SOCKET", "")
+			fd, r := readyPipe(t)
+
+			if err := tt.notify(newNotifier(fd)); err != nil {
+				t.Fatalf("notify error = %v", err)
+			}
+			// 通知した後は閉じられているため、EOFまで読める
+			var got string
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				got += scanner.Text() + "\n"
+			}
+			if got != tt.want {
+				t.Errorf("ready-fd = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifier_readyFailed(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	fd, r := readyPipe(t)
+	// 起動した側が終了している
+	_ = r.Close()
+
+	if err := newNotifier(fd).Ready(); !errors.Is(err, syscall.EPIPE) {
+		t.Errorf("Ready() error = %v, want %v", err, syscall.EPIPE)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	// --ready-fdが無くてもsystemdには通知する
+	n := newNotifier(0)
+	if err := n.Ready(); err != nil {
+		t.Fatalf("Ready() error = %v", err)
+	}
+	n.Stopping()
+
+	buf := make([]byte, 64)
+	for _, want := range []string{"READY=1", "STOPPING=1"} {
+		size, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:size]); got != want {
+			t.Errorf("NOTIFY_SOCKET received %q, want %q", got, want)
+		}
+	}
+
+	// 通知先が無い場合はReadyが失敗する
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	if err := newNotifier(0).Ready(); err == nil {
+		t.Error("Ready() error = nil, want an error for a missing socket")
+	}
+}
@@ -0,0 +1,231 @@
+package fs
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlockCache はオブジェクトの内容を固定サイズのブロックに分けてディスクに保存する。
+// パスは <dir>/<ブロックサイズ>/<bucketとkeyのハッシュ>/<ETag>/<ブロック番号> で、ETagやブロックサイズが変わったブロックは使われない。
+// 再マウント後も使えるように、LRUの順序はファイルの更新時刻で表す。
+// 合計サイズの上限はプロセスごとに管理するため、同じdirを複数のマウントで共有すると合計で上限を超えることがある
+type BlockCache struct {
+	dir       string
+	blockSize int64
+	limit     int64
+
+	mu     sync.Mutex
+	lru    *list.List // 先頭ほど最近使われたブロック
+	blocks map[string]*list.Element
+	size   int64
+}
+
+const blockTempPrefix = ".block"
+
+type cachedBlock struct {
+	path string
+	size int64
+}
+
+// OpenBlockCache はdirに保存済みのブロックを読み込む。limitは合計サイズの上限で、超えた場合は古いブロックから削除する。0以下の場合は上限なし
+func OpenBlockCache(dir string, blockSize, limit int64) (*BlockCache, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid block size: %d", blockSize)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create block cache dir: %w", err)
+	}
+
+	c := &BlockCache{
+		dir:       dir,
+		blockSize: blockSize,
+		limit:     limit,
+		lru:       list.New(),
+		blocks:    map[string]*list.Element{},
+	}
+
+	type stored struct {
+		cachedBlock
+		modTime time.Time
+	}
+	var all []stored
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), blockTempPrefix) {
+			return os.Remove(path) // 書き込み途中で終了した場合の一時ファイル
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		all = append(all, stored{cachedBlock{path: path, size: info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk block cache dir: %w", err)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].modTime.After(all[j].modTime)
+	})
+	for _, v := range all {
+		c.blocks[v.path] = c.lru.PushBack(&cachedBlock{path: v.path, size: v.size})
+		c.size += v.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	log.Printf("block cache dir:%s blocks:%d size:%d\n", dir, c.lru.Len(), c.size)
+	return c, nil
+}
+
+// BlockSize はブロックのサイズを返す
+func (c *BlockCache) BlockSize() int64 {
+	return c.blockSize
+}
+
+// Get はブロックを返す。無い場合や長さがsizeと異なる場合はfalseを返す
+func (c *BlockCache) Get(bucket, key, etag string, index, size int64) ([]byte, bool) {
+	path := c.path(bucket, key, etag, index)
+
+	c.mu.Lock()
+	e, ok := c.blocks[path]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Println("read cached block:", err)
+		c.remove(path)
+		return nil, false
+	}
+	if int64(len(data)) != size {
+		log.Printf("cached block %s has %d bytes, want %d\n", path, len(data), size)
+		c.remove(path)
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now) // 再マウント後のLRUの順序のため
+	return data, true
+}
+
+// Put はブロックを保存する。同じオブジェクトの古いETagのブロックは削除する
+func (c *BlockCache) Put(bucket, key, etag string, index int64, data []byte) error {
+	path := c.path(bucket, key, etag, index)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create block dir: %w", err)
+	}
+
+	// 書き込み途中のファイルを読まないように、一時ファイルに書いてからリネームする
+	temp, err := os.CreateTemp(filepath.Dir(path), blockTempPrefix)
+	if err != nil {
+		return fmt.Errorf("create temp block: %w", err)
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return fmt.Errorf("write block: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("close block: %w", err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("rename block: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeStale(filepath.Dir(filepath.Dir(path)), filepath.Dir(path))
+
+	if e, ok := c.blocks[path]; ok {
+		c.size -= e.Value.(*cachedBlock).size
+		c.lru.Remove(e)
+	}
+	c.blocks[path] = c.lru.PushFront(&cachedBlock{path: path, size: int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+// Stats はブロック数と合計サイズを返す
+func (c *BlockCache) Stats() (blocks int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.size
+}
+
+func (c *BlockCache) path(bucket, key, etag string, index int64) string {
+	return filepath.Join(c.dir, strconv.FormatInt(c.blockSize, 10), keyGen([]byte(bucket+"\x00"+key)), url.PathEscape(strings.Trim(etag, `"`)), strconv.FormatInt(index, 10))
+}
+
+func (c *BlockCache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.blocks[path]; ok {
+		c.size -= e.Value.(*cachedBlock).size
+		c.lru.Remove(e)
+		delete(c.blocks, path)
+	}
+	_ = os.Remove(path)
+}
+
+// removeStale はオブジェクトのディレクトリから、current以外のETagのブロックを削除する。muをロックして呼び出す
+func (c *BlockCache) removeStale(objectDir, current string) {
+	entries, err := os.ReadDir(objectDir)
+	if err != nil {
+		return
+	}
+	for _, v := range entries {
+		etagDir := filepath.Join(objectDir, v.Name())
+		if etagDir == current {
+			continue
+		}
+		for path, e := range c.blocks {
+			if filepath.Dir(path) == etagDir {
+				c.size -= e.Value.(*cachedBlock).size
+				c.lru.Remove(e)
+				delete(c.blocks, path)
+			}
+		}
+		_ = os.RemoveAll(etagDir)
+	}
+}
+
+// evict は上限を超えた分を古いブロックから削除する。muをロックして呼び出す
+func (c *BlockCache) evict() {
+	for c.limit > 0 && c.size > c.limit {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		b := e.Value.(*cachedBlock)
+		c.size -= b.size
+		c.lru.Remove(e)
+		delete(c.blocks, b.path)
+		_ = os.Remove(b.path)
+	}
+}
@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := OpenBlockCache(dir, 4, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range []string{"aaaa", "bbbb", "cccc"} {
+		if err := c.Put("example", "data.bin", `"etag1"`, int64(i), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, ok := c.Get("example", "data.bin", `"etag1"`, 0, 4); !ok || !bytes.Equal(got, []byte("aaaa")) {
+		t.Fatalf("Get() = %s, %v, want aaaa, true", got, ok)
+	}
+
+	// 上限を超えると最も長く使われていないブロック(1番目)が削除される
+	if err := c.Put("example", "other.bin", `"etag1"`, 0, []byte("dddd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("example", "data.bin", `"etag1"`, 1, 4); ok {
+		t.Errorf("block 1 should be evicted")
+	}
+	if _, ok := c.Get("example", "data.bin", `"etag1"`, 0, 4); !ok {
+		t.Errorf("block 0 should not be evicted")
+	}
+
+	// ETagが変わると古いブロックは使われず、削除される
+	if _, ok := c.Get("example", "data.bin", `"etag2"`, 0, 4); ok {
+		t.Errorf("block with another etag should not be found")
+	}
+	if err := c.Put("example", "data.bin", `"etag2"`, 0, []byte("eeee")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("example", "data.bin", `"etag1"`, 0, 4); ok {
+		t.Errorf("stale block should be removed")
+	}
+
+	// 再マウント後も使える
+	reopened, err := OpenBlockCache(dir, 4, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reopened.Get("example", "data.bin", `"etag2"`, 0, 4); !ok || !bytes.Equal(got, []byte("eeee")) {
+		t.Errorf("Get() after reopen = %s, %v, want eeee, true", got, ok)
+	}
+	if blocks, size := reopened.Stats(); blocks != 2 || size != 8 {
+		t.Errorf("Stats() = %d, %d, want 2, 8", blocks, size)
+	}
+
+	// 長さが異なるブロックは使わない
+	if _, ok := reopened.Get("example", "data.bin", `"etag2"`, 0, 3); ok {
+		t.Errorf("block with another length should not be found")
+	}
+
+	// ブロックサイズを変えて再マウントした場合は以前のブロックを使わない。
+	// 6バイトのオブジェクトの最後のブロックは、ブロックサイズ4でも2でも長さが2になる
+	if err := reopened.Put("example", "six.bin", `"etag1"`, 1, []byte("ef")); err != nil {
+		t.Fatal(err)
+	}
+	resized, err := OpenBlockCache(dir, 2, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := resized.Get("example", "six.bin", `"etag1"`, 1, 2); ok {
+		t.Errorf("Get() with another block size = %s, want a miss", got)
+	}
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"strings"
+	"time"
+)
+
+// CacheTTL はS3の問い合わせ結果をキャッシュする期間。0以下の場合はキャッシュしない
+type CacheTTL struct {
+	// List ListObjectsV2の結果
+	List time.Duration `yaml:"list"`
+	// Attr HeadObjectやリスト結果から得たファイル、ディレクトリの属性とバケットの存在
+	Attr time.Duration `yaml:"attr"`
+	// Negative 存在しなかったという結果
+	Negative time.Duration `yaml:"negative"`
+}
+
+// ttl はバケットに適用するキャッシュ期間を返す。バケットごとの設定があればそちらを優先する
+func (s *S3Session) ttl(bucket string) CacheTTL {
+	if v, ok := s.opts.BucketCacheTTL[bucket]; ok {
+		return v
+	}
+	return s.opts.CacheTTL
+}
+
+func (s *S3Session) setCache(k string, v interface{}, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	s.cache.Set(k, v, ttl)
+}
+
+// addCache はキャッシュが無い場合のみ登録する
+func (s *S3Session) addCache(k string, v interface{}, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	_ = s.cache.Add(k, v, ttl)
+}
+
+// CacheStats はキャッシュの件数とブロックキャッシュの使用量
+type CacheStats struct {
+	Lists      int   `json:"lists"`
+	Dirs       int   `json:"dirs"`
+	Attrs      int   `json:"attrs"`
+	Negatives  int   `json:"negatives"`
+	Blocks     int   `json:"blocks"`
+	BlockBytes int64 `json:"block_bytes"`
+}
+
+// CacheStats は期限切れでないキャッシュの件数を返す
+func (s *S3Session) CacheStats() CacheStats {
+	var stats CacheStats
+	for k := range s.cache.Items() {
+		switch {
+		case strings.HasPrefix(k, dirCachePrefix):
+			stats.Dirs++
+		case strings.HasPrefix(k, statCachePrefix), strings.HasPrefix(k, "exists-bucket:"):
+			stats.Attrs++
+		case strings.HasPrefix(k, negCachePrefix):
+			stats.Negatives++
+		default:
+			stats.Lists++
+		}
+	}
+	if s.opts.BlockCache != nil {
+		stats.Blocks, stats.BlockBytes = s.opts.BlockCache.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,101 @@
+package fs
+
+import (
+	"github.com/patrickmn/go-cache"
+	"testing"
+	"time"
+)
+
+func TestS3Session_ttl(t *testing.T) {
+	s := &S3Session{
+		cache: cache.New(cache.NoExpiration, time.Minute),
+		opts: S3Options{
+			CacheTTL: CacheTTL{List: 5 * time.Second, Attr: 5 * time.Second, Negative: time.Second},
+			BucketCacheTTL: map[string]CacheTTL{
+				"fixtures": {List: time.Hour, Attr: time.Hour, Negative: time.Hour},
+				"output":   {},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		bucket    string
+		want      CacheTTL
+		wantCache bool
+	}{
+		{
+			name:      "default",
+			bucket:    "example",
+			want:      CacheTTL{List: 5 * time.Second, Attr: 5 * time.Second, Negative: time.Second},
+			wantCache: true,
+		},
+		{
+			name:      "bucket override",
+			bucket:    "fixtures",
+			want:      CacheTTL{List: time.Hour, Attr: time.Hour, Negative: time.Hour},
+			wantCache: true,
+		},
+		{
+			name:      "never cached",
+			bucket:    "output",
+			want:      CacheTTL{},
+			wantCache: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.ttl(tt.bucket)
+			if got != tt.want {
+				t.Errorf("ttl() = %v, want %v", got, tt.want)
+			}
+
+			s.setCache(cacheKey(tt.bucket, "key"), true, got.Attr)
+			if _, found := s.cache.Get(cacheKey(tt.bucket, "key")); found != tt.wantCache {
+				t.Errorf("cached = %v, want %v", found, tt.wantCache)
+			}
+		})
+	}
+}
+
+func TestS3Session_negativeCache(t *testing.T) {
+	s := &S3Session{
+		cache: cache.New(cache.NoExpiration, time.Minute),
+		opts:  S3Options{CacheTTL: CacheTTL{Negative: time.Minute}},
+	}
+	for _, key := range []string{"a", "a/b", "a/b/c.txt", "other"} {
+		s.setCache(cacheKey(negCachePrefix+"example", key), true, s.ttl("example").Negative)
+	}
+
+	// キャッシュされたミスはS3に問い合わせずにnilを返す(svcがnilのため問い合わせるとpanicする)
+	obj, err := s.Lookup("example", "a/b/c.txt")
+	if obj != nil || err != nil {
+		t.Fatalf("Lookup() = %v, %v, want nil, nil", obj, err)
+	}
+
+	s.invalidate("example", "a/b/c.txt")
+	for key, want := range map[string]bool{"a": false, "a/b": false, "a/b/c.txt": false, "other": true} {
+		if _, found := s.cache.Get(cacheKey(negCachePrefix+"example", key)); found != want {
+			t.Errorf("negative cache of %s = %v, want %v", key, found, want)
+		}
+	}
+}
+
+func TestS3Session_CacheStats(t *testing.T) {
+	s := &S3Session{
+		cache: cache.New(cache.NoExpiration, time.Minute),
+		opts:  S3Options{CacheTTL: CacheTTL{List: time.Minute, Attr: time.Minute, Negative: time.Minute}},
+	}
+	s.setCache(cacheKey("list-buckets", ""), nil, time.Minute)
+	s.setCache(cacheKey(dirCachePrefix+"example", "a"), nil, time.Minute)
+	s.setCache(cacheKey(statCachePrefix+"example", "a/b.txt"), nil, time.Minute)
+	s.setCache(cacheKey("exists-bucket", "example"), true, time.Minute)
+	s.setCache(cacheKey(negCachePrefix+"example", "a/c.txt"), true, time.Minute)
+	s.setCache(cacheKey(negCachePrefix+"example", "a/d.txt"), true, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	want := CacheStats{Lists: 1, Dirs: 1, Attrs: 2, Negatives: 1}
+	if got := s.CacheStats(); got != want {
+		t.Errorf("CacheStats() = %+v, want %+v", got, want)
+	}
+}
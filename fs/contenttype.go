@@ -0,0 +1,37 @@
+package fs
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sniffLen はhttp.DetectContentTypeが参照する先頭のバイト数
+const sniffLen = 512
+
+// DetectContentType はキーの拡張子か、先頭のバイト列からContent-Typeを推測する。
+// overridesは拡張子(".js"など)ごとの上書きで、mimeパッケージの対応表より優先する。推測できない場合は空文字を返す
+func DetectContentType(key string, head []byte, overrides map[string]string) string {
+	if strings.HasSuffix(key, "/") {
+		return "" // フォルダオブジェクト
+	}
+
+	ext := strings.ToLower(path.Ext(key))
+	if ext != "" {
+		if v, ok := overrides[ext]; ok {
+			return v
+		}
+		if v := mime.TypeByExtension(ext); v != "" {
+			return v
+		}
+	}
+
+	if len(head) == 0 {
+		return ""
+	}
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	return http.DetectContentType(head)
+}
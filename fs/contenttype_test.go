@@ -0,0 +1,96 @@
+package fs
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"strings"
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		head      []byte
+		overrides map[string]string
+		want      string
+	}{
+		{
+			name: "extension",
+			key:  "assets/index.html",
+			want: "text/html; charset=utf-8",
+		},
+		{
+			name: "extension is case insensitive",
+			key:  "images/logo.PNG",
+			want: "image/png",
+		},
+		{
+			name:      "override",
+			key:       "data/app.js",
+			overrides: map[string]string{".js": "application/javascript"},
+			want:      "application/javascript",
+		},
+		{
+			name: "sniff unknown extension",
+			key:  "data/report",
+			head: []byte("<!DOCTYPE html><html></html>"),
+			want: "text/html; charset=utf-8",
+		},
+		{
+			name: "sniff plain text",
+			key:  "data/notes.unknownext",
+			head: []byte("hello world"),
+			want: "text/plain; charset=utf-8",
+		},
+		{
+			name: "empty body without extension",
+			key:  "data/empty",
+			want: "",
+		},
+		{
+			name: "folder object",
+			key:  "data/",
+			head: []byte("hello world"),
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectContentType(tt.key, tt.head, tt.overrides); got != tt.want {
+				t.Errorf("DetectContentType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3Session_contentType(t *testing.T) {
+	sess := newTestSession(t, S3Options{PreserveContentType: true})
+	_, err := sess.svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(testBucket),
+		Key:         aws.String("empty.dat"),
+		Body:        strings.NewReader(""),
+		ContentType: aws.String("text/csv"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		preserve bool
+		want     string
+	}{
+		{name: "existing empty object", key: "empty.dat", preserve: true, want: "text/csv"},
+		{name: "created by Create", key: "empty.dat", preserve: false, want: "text/plain; charset=utf-8"},
+		{name: "new object", key: "new.dat", preserve: true, want: "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aws.StringValue(sess.contentType(testBucket, tt.key, []byte("hello world"), tt.preserve)); got != tt.want {
+				t.Errorf("contentType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
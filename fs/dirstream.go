@@ -0,0 +1,113 @@
+package fs
+
+import (
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"log"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// dirStream はディレクトリの一覧を、カーネルが読み進めるのに合わせてS3から1ページずつ取得する。
+// 大きなディレクトリでも、すべてのページを取得し終えるのを待たずにエントリを返し始める
+type dirStream struct {
+	f      *FileSystem
+	name   string
+	prefix string
+	pages  *DirPages
+
+	// entries 取得済みのページのうち、まだ返していないエントリ
+	entries []fuse.DirEntry
+	// seen 返したエントリの名前。フォルダオブジェクトがCommonPrefixesとContentsの両方に含まれる実装があるため重複を除く
+	seen  map[string]bool
+	errno syscall.Errno
+}
+
+var _ fusefs.DirStream = (*dirStream)(nil)
+
+func (f *FileSystem) newDirStream(name, bucket, prefix string) *dirStream {
+	return &dirStream{
+		f:      f,
+		name:   name,
+		prefix: prefix,
+		pages:  f.sess.ListDirPages(bucket, prefix),
+		seen:   map[string]bool{},
+	}
+}
+
+func (d *dirStream) HasNext() bool {
+	for len(d.entries) == 0 && d.errno == fusefs.OK {
+		page, err := d.pages.Next()
+		if err != nil {
+			log.Println("list dir:", err)
+			d.errno = syscall.EIO
+			break
+		}
+		if page == nil {
+			// 最後まで読んだ場合のみ、一覧から消えたエントリの番号を破棄できる
+			d.f.retainInodes(d.name, d.seen)
+			return false
+		}
+		d.addPage(page)
+	}
+	return len(d.entries) > 0 || d.errno != fusefs.OK
+}
+
+func (d *dirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if len(d.entries) == 0 {
+		return fuse.DirEntry{}, d.errno
+	}
+	e := d.entries[0]
+	d.entries = d.entries[1:]
+	return e, fusefs.OK
+}
+
+func (d *dirStream) Close() {}
+
+func (d *dirStream) addPage(page *S3Dir) {
+	for _, p := range page.Prefixes {
+		d.add(strings.TrimSuffix(strings.TrimPrefix(p, d.prefix), "/"), fuse.S_IFDIR|0755)
+	}
+	for _, obj := range page.Objects {
+		fileName := strings.TrimPrefix(obj.Key, d.prefix)
+		if fileName == "" {
+			continue // ディレクトリ自身のフォルダオブジェクト
+		}
+
+		// 末尾スラッシュのオブジェクトはフォルダとして扱う
+		if strings.HasSuffix(fileName, "/") {
+			d.add(strings.TrimSuffix(fileName, "/"), fuse.S_IFDIR|0755)
+			continue
+		}
+
+		var mode uint32 = fuse.S_IFREG | 0777
+		if obj.Size == 0 && d.isSymlink(obj.Key) {
+			mode = fuse.S_IFLNK | 0777
+		}
+		d.add(fileName, mode)
+	}
+}
+
+// isSymlink は空のオブジェクトkeyがシンボリックリンクかを、HeadObject済みのメタデータから判断する。
+// 一覧のためにHeadObjectはしないので、まだstatされていないシンボリックリンクはLookupされるまで通常のファイルとして返す
+func (d *dirStream) isSymlink(key string) bool {
+	obj := d.f.sess.cached(d.pages.bucket, key)
+	if obj == nil {
+		return false
+	}
+	_, ok := symlinkTarget(obj.Metadata)
+	return ok
+}
+
+func (d *dirStream) add(entryName string, mode uint32) {
+	if entryName == "" || d.seen[entryName] {
+		return
+	}
+	d.seen[entryName] = true
+	d.entries = append(d.entries, fuse.DirEntry{
+		Name: entryName,
+		Ino:  d.f.ino(path.Join(d.name, entryName)),
+		Mode: mode,
+	})
+}
@@ -1,136 +1,466 @@
 package fs
 
 import (
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"context"
+	"fmt"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type S3File struct {
-	nodefs.File
+	// node ファイルを開いたノード。Release時に登録を解除する
+	node *Node
 
+	// bucket, key 読み書きするオブジェクト。開いた後にリネームされた場合はlocateで移動先に変わる
 	bucket string
 	key    string
 
 	sess *S3Session
 
+	// metadata アップロード時に引き継ぐユーザメタデータ。nilの場合はアップロード前に既存のオブジェクトから取得する
+	metadata map[string]*string
+
+	// created Createで作った空のオブジェクトに書き込んでいる。Content-Typeは引き継がずに内容から推測する
+	created bool
+
+	// 書き込み中にUtimensで指定された時刻。指定が無ければアップロード時の時刻をmtimeとする
+	atime *time.Time
+	mtime *time.Time
+
+	mu sync.Mutex
+
 	temp *os.File
+
+	// マルチパートアップロード。一時ファイルのうちuploadedバイト目までをパートとしてアップロード済み
+	multipartThreshold int64
+	partSize           int64
+	upload             *MultipartUpload
+	uploaded           int64
+
+	// 先読みバッファ
+	readAhead int64
+	buf       []byte
+	bufOff    int64
+	lastEnd   int64
 }
 
-func (f *S3File) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+var (
+	_ fusefs.FileReader    = (*S3File)(nil)
+	_ fusefs.FileWriter    = (*S3File)(nil)
+	_ fusefs.FileFlusher   = (*S3File)(nil)
+	_ fusefs.FileReleaser  = (*S3File)(nil)
+	_ fusefs.FileFsyncer   = (*S3File)(nil)
+	_ fusefs.FileAllocater = (*S3File)(nil)
+)
+
+func (f *S3File) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	log.Println("s3file Read off:", off)
 
-	data, err := f.sess.Get(f.bucket, f.key)
-	if err != nil {
-		return nil, fuse.EIO
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.locate()
+
+	if f.temp != nil {
+		// 書き込み中の内容を優先する
+		n, err := f.temp.ReadAt(dest, off)
+		if err != nil && err != io.EOF {
+			return nil, syscall.EIO
+		}
+		return fuse.ReadResultData(dest[:n]), fusefs.OK
+	}
+
+	end := off + int64(len(dest))
+	if f.buf != nil && f.bufOff <= off && end <= f.bufOff+int64(len(f.buf)) {
+		f.lastEnd = end
+		return fuse.ReadResultData(f.buf[off-f.bufOff : end-f.bufOff]), fusefs.OK
 	}
-	end := int(off) + len(dest)
-	if end > len(data) {
-		end = len(data)
+
+	// 前回の続きからの読み込みであれば、シーケンシャルリードとみなして先読みする
+	length := int64(len(dest))
+	if off == f.lastEnd && f.readAhead > length {
+		length = f.readAhead
 	}
 
-	return fuse.ReadResultData(data[off:end]), fuse.OK
+	data, err := f.sess.GetRange(f.bucket, f.key, off, length)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	f.buf, f.bufOff = data, off
+
+	if int64(len(data)) < end-off {
+		end = off + int64(len(data)) // EOF
+	}
+	f.lastEnd = end
+	return fuse.ReadResultData(data[:end-off]), fusefs.OK
 }
 
-func (f *S3File) Write(data []byte, off int64) (written uint32, code fuse.Status) {
+func (f *S3File) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
 	log.Println("s3file Write", "off:", off)
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.locate()
+
+	f.buf = nil // 書き込み前の内容を先読みバッファから返さないように
+
 	if f.temp == nil {
 		// 追記するには一度getする必要がある
-		get, err := f.sess.Get(f.bucket, f.key)
+		temp, err := os.CreateTemp("", "localstackmount")
 		if err != nil {
-			return 0, fuse.EIO
+			return 0, syscall.EIO
 		}
+		f.temp = temp
 
-		temp, err := os.CreateTemp("", "localstackmount")
+		if err := f.sess.Download(f.bucket, f.key, temp); err != nil {
+			log.Println("download:", err)
+			f.removeTemp()
+			return 0, syscall.EIO
+		}
+	}
+
+	if f.upload != nil && off < f.uploaded {
+		// アップロード済みのパートを書き換える場合は、マルチパートをやめてFlush時にまとめてアップロードする
+		f.abortUpload()
+	}
+
+	length, err := f.temp.WriteAt(data, off)
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	f.mtime = nil // 書き込み後は現在時刻に更新する
+
+	if err := f.uploadParts(off + int64(length)); err != nil {
+		log.Println("upload parts:", err)
+		f.abortUpload()
+		return 0, syscall.EIO
+	}
+	return uint32(length), fusefs.OK
+}
+
+// uploadParts はシーケンシャルに書き込まれた範囲(endバイト目まで)のうち、パートサイズに達した分をアップロードする
+func (f *S3File) uploadParts(end int64) error {
+	if f.multipartThreshold <= 0 || f.partSize < minPartSize {
+		return nil // マルチパートを利用しない
+	}
+	if f.upload == nil && (f.uploaded > 0 || end < f.multipartThreshold) {
+		return nil
+	}
+
+	if f.upload == nil {
+		metadata, err := f.uploadMeta()
+		if err != nil {
+			return err
+		}
+		head := make([]byte, sniffLen)
+		n, err := f.temp.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read temp: %w", err)
+		}
+		upload, err := f.sess.NewMultipartUpload(f.bucket, f.key, metadata, head[:n], !f.created)
 		if err != nil {
-			return 0, fuse.EIO
+			return err
 		}
+		f.upload = upload
+	}
 
-		if _, err := temp.Write(get); err != nil {
-			return 0, fuse.EIO
+	for f.uploaded+f.partSize <= end {
+		if err := f.uploadPart(f.partSize); err != nil {
+			return err
 		}
-		f.temp = temp
 	}
+	return nil
+}
 
-	length, err := f.temp.WriteAt(data, off)
+func (f *S3File) uploadPart(size int64) error {
+	part := make([]byte, size)
+	n, err := f.temp.ReadAt(part, f.uploaded)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("read temp: %w", err)
+	}
 
-	if _, err := f.temp.Seek(0, 0); err != nil { // 書き込んで分をflushで読み取らせるため、seekで位置を戻す
-		log.Println("seek err:", err)
-		return 0, fuse.EIO
+	if err := f.upload.UploadPart(part[:n]); err != nil {
+		return err
 	}
+	f.uploaded += int64(n)
+	return nil
+}
 
-	if err != nil {
-		return 0, fuse.EIO
+func (f *S3File) abortUpload() {
+	if f.upload == nil {
+		return
+	}
+	if err := f.upload.Abort(); err != nil {
+		log.Println("abort upload:", err)
 	}
-	return uint32(length), fuse.OK
+
+	// 以降はマルチパートにせず、Flush時に一時ファイル全体をアップロードする
+	f.upload = nil
 }
 
-func (f *S3File) Release() {
+func (f *S3File) Release(ctx context.Context) syscall.Errno {
 	log.Println("s3file Release")
 
-	if f.temp != nil {
-		defer func() {
-			_ = os.Remove(f.temp.Name())
-			f.temp = nil
-		}()
+	if f.node != nil {
+		f.node.removeFile(f)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Flushされずに残った書き込みがあればアップロードする
+	if errno := f.flush(); errno != fusefs.OK {
+		// 再試行できるハンドルはもう無いため、書き込んだ内容を失わないように一時ファイルを残す
+		log.Println("release flush:", errno, "written data is kept at", f.temp.Name())
+		_ = f.temp.Close()
+		f.temp = nil
 	}
+	return fusefs.OK
 }
 
-func (f *S3File) Flush() fuse.Status {
+func (f *S3File) Flush(ctx context.Context) syscall.Errno {
 	log.Println("s3file Flush")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.flush()
+}
+
+// flush は書き込み中の内容をアップロードする。失敗した場合は再試行できるように一時ファイルを残す
+func (f *S3File) flush() syscall.Errno {
 	if f.temp == nil {
-		return fuse.OK
+		return fusefs.OK
+	}
+	f.buf = nil
+	f.locate()
+
+	if f.upload != nil {
+		if err := f.completeUpload(); err != nil {
+			log.Println("complete upload:", err)
+			f.abortUpload()
+			return syscall.EIO
+		}
+		f.removeTemp()
+		return fusefs.OK
 	}
-	defer func() {
-		_ = os.Remove(f.temp.Name())
-		f.temp = nil
-	}()
 
-	body, err := io.ReadAll(f.temp)
+	// 一時ファイルから直接アップロードするため、メモリに読み込まない
+	if _, err := f.temp.Seek(0, io.SeekStart); err != nil {
+		log.Println("seek err:", err)
+		return syscall.EIO
+	}
+	metadata, err := f.uploadMeta()
 	if err != nil {
-		return fuse.EIO
+		log.Println("upload metadata:", err)
+		return syscall.EIO
+	}
+	if err := f.sess.putObject(f.bucket, f.key, f.temp, metadata, !f.created); err != nil {
+		log.Println("put object:", err)
+		return syscall.EIO
 	}
+	f.removeTemp()
+	return fusefs.OK
+}
 
-	if err := f.sess.PutBytes(f.bucket, f.key, body); err != nil {
-		return fuse.EIO
+// uploadMeta はアップロードするオブジェクトのユーザメタデータを返す。mtimeは書き込んだ時刻かUtimensで指定された時刻になる
+func (f *S3File) uploadMeta() (map[string]*string, error) {
+	metadata, err := f.currentMeta()
+	if err != nil {
+		return nil, err
 	}
-	return fuse.OK
+
+	mtime := time.Now()
+	if f.mtime != nil {
+		mtime = *f.mtime
+	}
+	update := timesMeta(f.atime, &mtime)
+	return mergeMeta(metadata, update), nil
 }
 
-func (f *S3File) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
-	// TODO metadataにatime, mimeなどを格納する？
-	// https://stackoverflow.com/questions/13455168/is-there-a-way-to-touch-a-file-in-amazon-s3
-	return fuse.OK
+// currentMeta は上書きによってモードや所有者が失われないよう、既存のオブジェクトのユーザメタデータを返す
+func (f *S3File) currentMeta() (map[string]*string, error) {
+	if f.metadata != nil {
+		return f.metadata, nil
+	}
+
+	obj, err := f.sess.Stat(f.bucket, f.key)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil || strings.HasSuffix(obj.Key, "/") {
+		return nil, nil
+	}
+	f.metadata = obj.Metadata
+	return f.metadata, nil
 }
 
-func (f *S3File) Truncate(size uint64) fuse.Status {
-	log.Println("s3file Truncate size:", size)
+func (f *S3File) completeUpload() error {
+	stat, err := f.temp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat temp: %w", err)
+	}
 
-	if f.temp != nil {
-		_ = os.Remove(f.temp.Name())
+	// 残りを最終パートとしてアップロードする
+	for f.uploaded < stat.Size() {
+		if err := f.uploadPart(f.partSize); err != nil {
+			return err
+		}
 	}
 
-	temp, err := os.CreateTemp("", "localstackmount")
+	if err := f.upload.Complete(); err != nil {
+		return err
+	}
+	f.upload = nil
+
+	if f.mtime != nil || f.atime != nil {
+		// マルチパートの開始後にUtimensで指定された時刻を反映する
+		return f.sess.UpdateMetadata(f.bucket, f.key, timesMeta(f.atime, f.mtime))
+	}
+	return nil
+}
+
+// locate はファイルや親ディレクトリがリネームされていれば、読み書きするオブジェクトを移動先に変える。
+// 元のキーで始めたマルチパートアップロードは中止し、Flush時に一時ファイル全体をアップロードする。muをロックして呼び出す
+func (f *S3File) locate() {
+	if f.node == nil {
+		return
+	}
+	name, ok := f.node.attachedName()
+	if !ok {
+		return // 削除された
+	}
+	pos := f.node.fsys.parse(name)
+	if pos.Bucket == f.bucket && pos.Key == f.key {
+		return
+	}
+	log.Printf("s3file moved from %s/%s to %s/%s\n", f.bucket, f.key, pos.Bucket, pos.Key)
+
+	f.abortUpload()
+	f.bucket, f.key = pos.Bucket, pos.Key
+	f.buf = nil
+}
+
+func (f *S3File) removeTemp() {
+	_ = f.temp.Close()
+	_ = os.Remove(f.temp.Name())
+	f.temp = nil
+	f.uploaded = 0
+	f.atime, f.mtime = nil, nil
+}
+
+// writing は書き込み中の一時ファイルがあるかを返す
+func (f *S3File) writing() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.temp != nil
+}
+
+// utimens は書き込み中であれば時刻を記録してtrueを返す。書き込み中でなければノードがメタデータを書き換える
+func (f *S3File) utimens(atime *time.Time, mtime *time.Time) bool {
+	log.Println("s3file Utimens", atime, mtime)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.temp == nil {
+		return false
+	}
+
+	// アップロード時にメタデータとして保存する
+	if atime != nil {
+		f.atime = atime
+	}
+	if mtime != nil {
+		f.mtime = mtime
+	}
+	return true
+}
+
+// getattr は書き込み中であれば一時ファイルの属性をoutに設定してtrueを返す。書き込み中でなければS3のオブジェクトを参照させる
+func (f *S3File) getattr(out *fuse.Attr) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.temp == nil {
+		return false
+	}
+
+	// 書き込み中の場合はS3上のサイズではなく一時ファイルのサイズを返す
+	stat, err := f.temp.Stat()
 	if err != nil {
-		return fuse.EIO
+		return false
+	}
+	out.Mode = fuse.S_IFREG | 0777
+	out.Size = uint64(stat.Size())
+	out.Blocks = 1
+	mtime := timePtr(stat.ModTime())
+	if f.mtime != nil {
+		mtime = f.mtime
+	}
+	out.SetTimes(f.atime, mtime, timePtr(stat.ModTime()))
+	applyMeta(out, f.metadata)
+	return true
+}
+
+// truncate はファイルをsizeバイトに切り詰めるか、0で埋めて拡張する。書き込み中でなければ既存の内容を一時ファイルに取得する
+func (f *S3File) truncate(size uint64) syscall.Errno {
+	log.Println("s3file Truncate size:", size)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.locate()
+
+	f.buf = nil
+
+	if f.temp == nil {
+		temp, err := os.CreateTemp("", "localstackmount")
+		if err != nil {
+			return syscall.EIO
+		}
+		f.temp = temp
+
+		// 0バイトに切り詰める場合は既存の内容が残らないため取得しない
+		if size > 0 {
+			if err := f.sess.Download(f.bucket, f.key, temp); err != nil {
+				log.Println("download:", err)
+				f.removeTemp()
+				return syscall.EIO
+			}
+		}
 	}
-	f.temp = temp
 
-	return fuse.OK
+	if f.upload != nil && int64(size) < f.uploaded {
+		// アップロード済みのパートを切り詰める場合は、マルチパートをやめてFlush時にまとめてアップロードする
+		f.abortUpload()
+	}
+	if err := f.temp.Truncate(int64(size)); err != nil {
+		log.Println("truncate temp:", err)
+		return syscall.EIO
+	}
+	f.mtime = nil
+	return fusefs.OK
 }
 
-func (f *S3File) Allocate(off uint64, size uint64, mode uint32) (code fuse.Status) {
+func (f *S3File) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
 	log.Println("s3file Allocate")
-	return fuse.OK
+	return fusefs.OK
 }
 
-func (f *S3File) Fsync(flags int) (code fuse.Status) {
+func (f *S3File) Fsync(ctx context.Context, flags uint32) syscall.Errno {
 	log.Println("s3file Fsync flags:", flags)
-	return fuse.OK
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.flush()
 }
 
 func (f *S3File) String() string {
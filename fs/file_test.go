@@ -0,0 +1,262 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"syscall"
+	"testing"
+)
+
+func newTestFile(sess *S3Session, opts Options, key string) *S3File {
+	f := &FileSystem{sess: sess, opts: opts}
+	return f.newFile(Position{Bucket: testBucket, Key: key})
+}
+
+func TestS3File_multipart(t *testing.T) {
+	ctx := context.Background()
+	var c requestCounter
+	sess := newTestSessionWith(t, S3Options{}, c.wrap)
+	file := newTestFile(sess, Options{MultipartThreshold: minPartSize, PartSize: minPartSize}, "large.bin")
+	puts := c.count("PUT") // バケットの作成
+	if errno := file.truncate(0); errno != fusefs.OK {
+		t.Fatalf("truncate() = %v", errno)
+	}
+
+	// 1MiBずつシーケンシャルに書き込み、パートサイズに達した分は書き込み中にアップロードする
+	want := bytes.Repeat([]byte("0123456789abcdef"), 12<<20/16)
+	for off := 0; off < len(want); off += 1 << 20 {
+		if _, errno := file.Write(ctx, want[off:off+1<<20], int64(off)); errno != fusefs.OK {
+			t.Fatalf("Write() = %v", errno)
+		}
+	}
+	if got := c.count("PUT uploadPart"); got != 2 {
+		t.Errorf("parts uploaded while writing = %d, want 2", got)
+	}
+
+	if errno := file.Flush(ctx); errno != fusefs.OK {
+		t.Fatalf("Flush() = %v", errno)
+	}
+	if got := c.count("PUT uploadPart"); got != 3 {
+		t.Errorf("parts uploaded = %d, want 3", got)
+	}
+	if got := c.count("PUT") - puts; got != 0 {
+		t.Errorf("PutObject requests = %d, want 0", got)
+	}
+	got, err := getObject(sess, testBucket, "large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("object size = %d, want %d", len(got), len(want))
+	}
+}
+
+func TestS3File_belowMultipartThreshold(t *testing.T) {
+	ctx := context.Background()
+	var c requestCounter
+	sess := newTestSessionWith(t, S3Options{}, c.wrap)
+	file := newTestFile(sess, Options{MultipartThreshold: minPartSize, PartSize: minPartSize}, "small.txt")
+	if errno := file.truncate(0); errno != fusefs.OK {
+		t.Fatalf("truncate() = %v", errno)
+	}
+	if _, errno := file.Write(ctx, []byte("hello"), 0); errno != fusefs.OK {
+		t.Fatalf("Write() = %v", errno)
+	}
+	if errno := file.Flush(ctx); errno != fusefs.OK {
+		t.Fatalf("Flush() = %v", errno)
+	}
+	if got := c.count("POST createMultipart"); got != 0 {
+		t.Errorf("multipart uploads = %d, want 0", got)
+	}
+	if got, err := getObject(sess, testBucket, "small.txt"); err != nil || string(got) != "hello" {
+		t.Errorf("object = %q, %v, want hello", got, err)
+	}
+}
+
+func TestS3File_flushRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		size int
+	}{
+		{name: "put object", size: 5},
+		{name: "multipart", opts: Options{MultipartThreshold: minPartSize, PartSize: minPartSize}, size: minPartSize + 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var c requestCounter
+			sess := newTestSessionWith(t, S3Options{}, c.wrap)
+			file := newTestFile(sess, tt.opts, "a.txt")
+			if errno := file.truncate(0); errno != fusefs.OK {
+				t.Fatalf("truncate() = %v", errno)
+			}
+			want := bytes.Repeat([]byte("a"), tt.size)
+			if _, errno := file.Write(ctx, want, 0); errno != fusefs.OK {
+				t.Fatalf("Write() = %v", errno)
+			}
+
+			c.setFail(true)
+			if errno := file.Fsync(ctx, 0); errno != syscall.EIO {
+				t.Fatalf("Fsync() while failing = %v, want EIO", errno)
+			}
+			if !file.writing() {
+				t.Fatal("written data was discarded by the failed upload")
+			}
+
+			// 失敗した後も書き込んだ内容は残っており、再試行でアップロードできる
+			c.setFail(false)
+			if errno := file.Flush(ctx); errno != fusefs.OK {
+				t.Fatalf("Flush() = %v", errno)
+			}
+			if got, err := getObject(sess, testBucket, "a.txt"); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("object size = %d, %v, want %d", len(got), err, len(want))
+			}
+		})
+	}
+}
+
+func TestNode_OpenLazily(t *testing.T) {
+	tests := []struct {
+		name       string
+		flags      uint32
+		write      string
+		wantGets   int
+		wantObject string
+	}{
+		{name: "open only", flags: syscall.O_RDONLY, wantGets: 0, wantObject: "hello world"},
+		{name: "truncate", flags: syscall.O_WRONLY | syscall.O_TRUNC, write: "bye", wantGets: 0, wantObject: "bye"},
+		{name: "overwrite", flags: syscall.O_WRONLY, write: "HELLO", wantGets: 1, wantObject: "HELLO world"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var c requestCounter
+			sess := newTestSessionWith(t, S3Options{}, c.wrap)
+			if err := sess.PutBytes(testBucket, "a.txt", []byte("hello world")); err != nil {
+				t.Fatal(err)
+			}
+			n := lookupPath(t, newTestRoot(t, sess, Options{}), testBucket, "a.txt")
+			gets := c.count("GET")
+
+			fh, _, errno := n.Open(ctx, tt.flags)
+			if errno != fusefs.OK {
+				t.Fatalf("Open() = %v", errno)
+			}
+			file := fh.(*S3File)
+			if tt.write != "" {
+				if _, errno := file.Write(ctx, []byte(tt.write), 0); errno != fusefs.OK {
+					t.Fatalf("Write() = %v", errno)
+				}
+			}
+			if errno := file.Flush(ctx); errno != fusefs.OK {
+				t.Fatalf("Flush() = %v", errno)
+			}
+			// 本文のダウンロードは既存の内容が必要な書き込みの時だけ行う
+			if got := c.count("GET") - gets; got != tt.wantGets {
+				t.Errorf("GetObject requests = %d, want %d", got, tt.wantGets)
+			}
+			file.Release(ctx)
+
+			if got, err := getObject(sess, testBucket, "a.txt"); err != nil || string(got) != tt.wantObject {
+				t.Errorf("object = %q, %v, want %q", got, err, tt.wantObject)
+			}
+		})
+	}
+}
+
+func TestS3File_ReadAfterWrite(t *testing.T) {
+	ctx := context.Background()
+	sess := newTestSession(t, S3Options{})
+	if err := sess.PutBytes(testBucket, "a.txt", []byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	file := newTestFile(sess, Options{ReadAhead: 1 << 20}, "a.txt")
+
+	read := func() string {
+		t.Helper()
+		dest := make([]byte, 5)
+		res, errno := file.Read(ctx, dest, 0)
+		if errno != fusefs.OK {
+			t.Fatalf("Read() = %v", errno)
+		}
+		b, _ := res.Bytes(dest)
+		return string(b)
+	}
+
+	if got := read(); got != "hello" {
+		t.Fatalf("Read() = %q, want hello", got)
+	}
+	if _, errno := file.Write(ctx, []byte("HELLO"), 0); errno != fusefs.OK {
+		t.Fatalf("Write() = %v", errno)
+	}
+	if errno := file.Flush(ctx); errno != fusefs.OK {
+		t.Fatalf("Flush() = %v", errno)
+	}
+	// 先読みバッファに書き込み前の内容が残っていてはいけない
+	if got := read(); got != "HELLO" {
+		t.Errorf("Read() after write = %q, want HELLO", got)
+	}
+
+	if errno := file.truncate(2); errno != fusefs.OK {
+		t.Fatalf("truncate() = %v", errno)
+	}
+	if errno := file.Flush(ctx); errno != fusefs.OK {
+		t.Fatalf("Flush() = %v", errno)
+	}
+	if got := read(); got != "HE" {
+		t.Errorf("Read() after truncate = %q, want HE", got)
+	}
+}
+
+func TestS3File_renamedWhileWriting(t *testing.T) {
+	tests := []struct {
+		name    string
+		rename  []string // parentの子の元の名前と新しい名前
+		parent  []string
+		wantKey string
+	}{
+		{name: "file", parent: []string{testBucket, "dir"}, rename: []string{"a.txt", "b.txt"}, wantKey: "dir/b.txt"},
+		{name: "parent directory", parent: []string{testBucket}, rename: []string{"dir", "moved"}, wantKey: "moved/a.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			sess := newTestSession(t, S3Options{})
+			if err := sess.PutBytes(testBucket, "dir/a.txt", []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			root := newTestRoot(t, sess, Options{})
+			n := lookupPath(t, root, testBucket, "dir", "a.txt")
+
+			fh, _, errno := n.Open(ctx, syscall.O_WRONLY|syscall.O_TRUNC)
+			if errno != fusefs.OK {
+				t.Fatalf("Open() = %v", errno)
+			}
+			file := fh.(*S3File)
+			if _, errno := file.Write(ctx, []byte("bye"), 0); errno != fusefs.OK {
+				t.Fatalf("Write() = %v", errno)
+			}
+
+			// go-fuseはRenameが成功するとノードを移動する
+			parent := lookupPath(t, root, tt.parent...)
+			if errno := parent.Rename(ctx, tt.rename[0], parent, tt.rename[1], 0); errno != fusefs.OK {
+				t.Fatalf("Rename() = %v", errno)
+			}
+			parent.MvChild(tt.rename[0], parent.EmbeddedInode(), tt.rename[1], true)
+
+			if errno := file.Flush(ctx); errno != fusefs.OK {
+				t.Fatalf("Flush() = %v", errno)
+			}
+			file.Release(ctx)
+
+			if got, err := getObject(sess, testBucket, tt.wantKey); err != nil || string(got) != "bye" {
+				t.Errorf("object %s = %q, %v, want bye", tt.wantKey, got, err)
+			}
+			if sess.Exists(testBucket, "dir/a.txt") {
+				t.Errorf("dir/a.txt should not be uploaded again")
+			}
+		})
+	}
+}
@@ -1,175 +1,562 @@
 package fs
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/aws/aws-sdk-go/aws"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/spaolacci/murmur3"
-	"hash/fnv"
 	"log"
 	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// FileSystem はマウント全体で共有するS3のセッションと設定を持つ
 type FileSystem struct {
-	pathfs.FileSystem
-
 	sess *S3Session
 
+	opts Options
+
 	callTime *time.Time
+
+	inodes *InodeTable
+
+	// openETags KeepCache用に、前回Openした時のETagをパスごとに保持する
+	openETags sync.Map
+
+	// files 開かれているすべてのファイル。終了前にFlushAllでアップロードする
+	files sync.Map
 }
 
-func NewFileSystem(sess *S3Session) *pathfs.PathNodeFs {
-	return pathfs.NewPathNodeFs(&FileSystem{
-		FileSystem: pathfs.NewDefaultFileSystem(),
-		sess:       sess,
-		callTime:   timePtr(time.Now()),
-	}, nil)
+type Options struct {
+	// ReadAhead シーケンシャルリード時に先読みするバイト数。0の場合は先読みしない
+	ReadAhead int64
+
+	// MultipartThreshold 書き込みサイズがこれを超えるとマルチパートアップロードに切り替える。0の場合は利用しない
+	MultipartThreshold int64
+
+	// PartSize マルチパートアップロードの1パートのサイズ。5MiB以上を指定する
+	PartSize int64
+
+	// JournalDir ディレクトリのリネームの進捗を記録するディレクトリ。空の場合は記録しない
+	JournalDir string
+
+	// RenameRecovery 起動時に中断されたリネームを見つけた場合の復旧方法。RecoverForward か RecoverRollback
+	RenameRecovery string
+
+	// KeepCache 前回のOpenからETagが変わっていなければ、カーネルのページキャッシュを破棄せずに使う
+	KeepCache bool
+
+	// ClientInodes InodeTableで割り当てたinode番号を使う。falseの場合はgo-fuseが採番し、リネームで番号が変わる
+	ClientInodes bool
+
+	// Root マウントルートにするバケットとprefix。指定した場合、バケットの作成と削除はできない
+	Root Root
 }
 
-func (f *FileSystem) GetAttr(name string, ctx *fuse.Context) (*fuse.Attr, fuse.Status) {
-	pos := Parse(name)
+// Node はマウントルート、バケット、ディレクトリ、ファイルのいずれかのinode。パスはinodeの親子関係から求める
+type Node struct {
+	fusefs.Inode
 
-	if pos.IsMountRoot {
-		attr := &fuse.Attr{
-			Ino:  inodeHash(rootKey()),
-			Mode: fuse.S_IFDIR | 0777,
+	fsys *FileSystem
+
+	mu sync.Mutex
+	// files このノードで開かれているファイル。書き込み中のサイズや時刻はS3ではなくこちらを参照する
+	files map[*S3File]struct{}
+}
+
+var (
+	_ fusefs.NodeGetattrer   = (*Node)(nil)
+	_ fusefs.NodeSetattrer   = (*Node)(nil)
+	_ fusefs.NodeLookuper    = (*Node)(nil)
+	_ fusefs.NodeReaddirer   = (*Node)(nil)
+	_ fusefs.NodeOpener      = (*Node)(nil)
+	_ fusefs.NodeCreater     = (*Node)(nil)
+	_ fusefs.NodeMkdirer     = (*Node)(nil)
+	_ fusefs.NodeRenamer     = (*Node)(nil)
+	_ fusefs.NodeUnlinker    = (*Node)(nil)
+	_ fusefs.NodeRmdirer     = (*Node)(nil)
+	_ fusefs.NodeAccesser    = (*Node)(nil)
+	_ fusefs.NodeSymlinker   = (*Node)(nil)
+	_ fusefs.NodeReadlinker  = (*Node)(nil)
+	_ fusefs.NodeOnForgetter = (*Node)(nil)
+)
+
+// NewFileSystem はマウントルートのノードを返す
+func NewFileSystem(sess *S3Session, opts Options) *Node {
+	fs := &FileSystem{
+		sess:     sess,
+		opts:     opts,
+		callTime: timePtr(time.Now()),
+		inodes:   NewInodeTable(),
+	}
+
+	if err := fs.recoverRenames(); err != nil {
+		log.Println("recover renames:", err)
+	}
+	return &Node{fsys: fs}
+}
+
+// name はマウントルートからのパスを返す
+func (n *Node) name() string {
+	return n.Path(nil)
+}
+
+// attachedName はノードの現在のパスを返す。削除されてマウントルートから辿れない場合はfalseを返す
+func (n *Node) attachedName() (string, bool) {
+	var names []string
+	for p := &n.Inode; !p.IsRoot(); {
+		name, parent := p.Parent()
+		if parent == nil {
+			return "", false
 		}
+		names = append([]string{name}, names...)
+		p = parent
+	}
+	return path.Join(names...), true
+}
+
+// parse はマウントルートからのパスをバケットとキーに変換する
+func (f *FileSystem) parse(name string) Position {
+	return f.opts.Root.Parse(name)
+}
+
+func (n *Node) childName(name string) string {
+	return path.Join(n.name(), name)
+}
+
+// ino はパスのinode番号を返す。ClientInodesでない場合は0を返し、go-fuseに採番させる
+func (f *FileSystem) ino(name string) uint64 {
+	if !f.opts.ClientInodes {
+		return 0
+	}
+	return f.inodes.Get(name)
+}
+
+// newChild はnameの子ノードを返す。同じノードが既にあればそれを使い、開いているファイルの状態を引き継ぐ
+func (n *Node) newChild(ctx context.Context, name string, mode uint32) *fusefs.Inode {
+	var ino uint64
+	if n.fsys.opts.ClientInodes {
+		ino = n.fsys.inodes.Ref(n.childName(name))
+	}
+	attr := fusefs.StableAttr{Mode: mode & syscall.S_IFMT, Ino: ino}
+	if ch := n.GetChild(name); ch != nil && ch.Mode() == attr.Mode && (ino == 0 || ch.StableAttr().Ino == ino) {
+		return ch
+	}
+	return n.NewInode(ctx, &Node{fsys: n.fsys}, attr)
+}
+
+// OnForget はカーネルが忘れたinodeの番号をInodeTableから破棄する
+func (n *Node) OnForget() {
+	if n.fsys.opts.ClientInodes {
+		n.fsys.inodes.Forget(n.StableAttr().Ino)
+	}
+}
+
+func (n *Node) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	// 書き込み中の場合はS3上の状態ではなく一時ファイルを返す
+	if file := n.writingFile(fh); file != nil && file.getattr(&out.Attr) {
+		return fusefs.OK
+	}
+	return n.fsys.getAttr(n.name(), ctx, &out.Attr)
+}
+
+func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	childName := n.childName(name)
+	if errno := n.fsys.getAttr(childName, ctx, &out.Attr); errno != fusefs.OK {
+		return nil, errno
+	}
+
+	ch := n.newChild(ctx, name, out.Mode)
+	if file := ch.Operations().(*Node).writingFile(nil); file != nil {
+		file.getattr(&out.Attr)
+	}
+	return ch, fusefs.OK
+}
+
+func (f *FileSystem) getAttr(name string, ctx context.Context, attr *fuse.Attr) syscall.Errno {
+	pos := f.parse(name)
+
+	if pos.IsMountRoot {
+		attr.Ino = RootIno
+		attr.Mode = fuse.S_IFDIR | 0777
 		attr.SetTimes(f.callTime, f.callTime, f.callTime)
-		return attr, fuse.OK
+		return fusefs.OK
 	}
 
 	if pos.IsBucketRoot {
 		if f.sess.ExistsBucket(pos.Bucket) {
-			attr := &fuse.Attr{
-				Ino:  inodeHash(name),
-				Mode: fuse.S_IFDIR | 0777,
-			}
+			attr.Ino = f.ino(name)
+			attr.Mode = fuse.S_IFDIR | 0777
 			attr.SetTimes(f.callTime, f.callTime, f.callTime)
-			return attr, fuse.OK
+			return fusefs.OK
 		}
-		return nil, fuse.ENOENT
+		return syscall.ENOENT
 	}
 
 	log.Printf("GetAttr pos:%s\n", name)
 
-	list, err := f.sess.List(pos.Bucket, pos.Key)
+	obj, err := f.sess.Stat(pos.Bucket, pos.Key)
 	if err != nil {
-		return nil, fuse.EIO
+		return syscall.EIO
 	}
-	if len(list) == 0 {
-		return nil, fuse.ENOENT
+	if obj == nil {
+		return syscall.ENOENT
 	}
 
-	if list[0].Key == pos.Key || strings.TrimRight(list[0].Key, "/") == pos.Key {
-		// 完全一致の場合はS3オブジェクトであるのでファイルとして扱う。ただし末尾がスラッシュの場合はフォルダ扱いとする
-		var mode uint32 = fuse.S_IFREG | 0777
-
-		if strings.HasSuffix(list[0].Key, "/") {
-			mode = fuse.S_IFDIR | 0755
+	if strings.HasSuffix(obj.Key, "/") {
+		// フォルダオブジェクトか、配下にオブジェクトが存在するprefix
+		*attr = fuse.Attr{
+			Ino:  f.ino(name),
+			Mode: fuse.S_IFDIR | 0755,
 		}
-		attr := fuse.Attr{
-			Ino:    inodeHash(name),
-			Size:   uint64(list[0].Size),
-			Blocks: 1,
-			Mode:   mode,
+		if caller, ok := fuse.FromContext(ctx); ok {
+			attr.Owner = caller.Owner
 		}
-		attr.SetTimes(nil, list[0].LastModified, list[0].LastModified)
-		return &attr, fuse.OK
+		applyTimes(attr, obj.LastModified, obj.Metadata)
+		applyMeta(attr, obj.Metadata)
+		return fusefs.OK
 	}
 
-	listPaths := make([]string, 0, len(list))
-	for _, v := range list {
-		listPaths = append(listPaths, v.Key)
+	*attr = fuse.Attr{
+		Ino:    f.ino(name),
+		Size:   uint64(obj.Size),
+		Blocks: 1,
+		Mode:   fuse.S_IFREG | 0777,
 	}
+	if target, ok := symlinkTarget(obj.Metadata); ok {
+		attr.Mode = fuse.S_IFLNK | 0777
+		attr.Size = uint64(len(target))
+	}
+	applyTimes(attr, obj.LastModified, obj.Metadata)
+	applyMeta(attr, obj.Metadata)
+	return fusefs.OK
+}
+
+func (n *Node) Setattr(ctx context.Context, fh fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	name := n.name()
+	pos := n.fsys.parse(name)
+	file := n.writingFile(fh)
 
-	if !CanAccess(listPaths, pos.Key) {
-		// prefixで一致しても、パスの部分一致の可能性がある
-		return nil, fuse.ENOENT
+	if size, ok := in.GetSize(); ok {
+		if errno := n.truncate(pos, fh, size); errno != fusefs.OK {
+			return errno
+		}
+		file = n.writingFile(fh)
+	}
+
+	mode, hasMode := in.GetMode()
+	uid, hasUID := in.GetUID()
+	gid, hasGID := in.GetGID()
+	if hasMode || hasUID || hasGID {
+		log.Printf("Setattr pos:%+v mode:%o uid:%d gid:%d\n", pos, mode, uid, gid)
+
+		errno := n.fsys.updateMeta(pos, func(obj *S3Object) (map[string]string, syscall.Errno) {
+			update := map[string]string{}
+			if hasMode {
+				var fileType uint32 = fuse.S_IFREG
+				if strings.HasSuffix(obj.Key, "/") {
+					fileType = fuse.S_IFDIR
+				}
+				update[metaMode] = strconv.FormatUint(uint64(fileType|mode&07777), 10)
+			}
+			if hasUID && uid != ^uint32(0) { // -1 は変更しない
+				update[metaUID] = strconv.FormatUint(uint64(uid), 10)
+			}
+			if hasGID && gid != ^uint32(0) {
+				update[metaGID] = strconv.FormatUint(uint64(gid), 10)
+			}
+			return update, fusefs.OK
+		})
+		if errno != fusefs.OK {
+			return errno
+		}
 	}
 
-	return &fuse.Attr{
-		Ino:  inodeHash(name),
-		Mode: fuse.S_IFDIR | 0755,
-		Owner: fuse.Owner{
-			Uid: ctx.Owner.Uid,
-			Gid: ctx.Owner.Gid,
-		},
-	}, fuse.OK
+	atime, hasAtime := in.GetATime()
+	mtime, hasMtime := in.GetMTime()
+	if hasAtime || hasMtime {
+		var a, m *time.Time
+		if hasAtime {
+			a = &atime
+		}
+		if hasMtime {
+			m = &mtime
+		}
+		log.Println("Utimens pos:", pos, a, m)
 
+		// 書き込み中であればアップロード時にまとめて保存する
+		if file == nil || !file.utimens(a, m) {
+			errno := n.fsys.updateMeta(pos, func(obj *S3Object) (map[string]string, syscall.Errno) {
+				return timesMeta(a, m), fusefs.OK
+			})
+			if errno != fusefs.OK {
+				return errno
+			}
+		}
+	}
+
+	return n.Getattr(ctx, fh, out)
 }
 
-func (f *FileSystem) Open(name string, flags uint32, ctx *fuse.Context) (nodefs.File, fuse.Status) {
-	log.Println("Open name:", name)
-	pos := Parse(name)
+// truncate は開いているファイルを切り詰める。開かれていない場合はその場で開いて空のオブジェクトをアップロードする
+func (n *Node) truncate(pos Position, fh fusefs.FileHandle, size uint64) syscall.Errno {
+	if file, ok := fh.(*S3File); ok {
+		return file.truncate(size)
+	}
+	if file := n.writingFile(nil); file != nil {
+		return file.truncate(size)
+	}
 
-	get, err := f.sess.Get(pos.Bucket, pos.Key)
+	file := n.fsys.newFile(pos)
+	if errno := file.truncate(size); errno != fusefs.OK {
+		return errno
+	}
+	return file.Flush(context.Background())
+}
+
+// updateMeta はファイルかフォルダオブジェクトのユーザメタデータを書き換える。
+// フォルダオブジェクトを持たないディレクトリの場合は、メタデータを保存するためにフォルダオブジェクトを作成する
+func (f *FileSystem) updateMeta(pos Position, fn func(obj *S3Object) (map[string]string, syscall.Errno)) syscall.Errno {
+	if pos.IsMountRoot || pos.IsBucketRoot {
+		return syscall.EPERM
+	}
+
+	obj, err := f.sess.Stat(pos.Bucket, pos.Key)
 	if err != nil {
-		return nil, fuse.ENOENT
+		return syscall.EIO
+	}
+	if obj == nil {
+		return syscall.ENOENT
 	}
 
-	return &S3File{
-		File:   nodefs.NewDataFile(get),
-		bucket: pos.Bucket,
-		key:    pos.Key,
-		sess:   f.sess,
-	}, fuse.OK
+	update, errno := fn(obj)
+	if errno != fusefs.OK {
+		return errno
+	}
+	if len(update) == 0 {
+		return fusefs.OK
+	}
+
+	if strings.HasSuffix(obj.Key, "/") && obj.LastModified == nil {
+		if err := f.sess.PutWithMetadata(pos.Bucket, obj.Key, bytes.NewReader(nil), mergeMeta(nil, update)); err != nil {
+			log.Println("put folder object:", err)
+			return syscall.EIO
+		}
+		return fusefs.OK
+	}
+
+	if err := f.sess.UpdateMetadata(pos.Bucket, obj.Key, update); err != nil {
+		log.Println("update metadata:", err)
+		return syscall.EIO
+	}
+	return fusefs.OK
+}
+
+func (n *Node) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	name := n.name()
+	log.Println("Open name:", name, "flags:", flags)
+	pos := n.fsys.parse(name)
+
+	// オブジェクトの本文は最初のRead/Writeまで取得しない
+	file := n.fsys.newFile(pos)
+
+	if flags&syscall.O_TRUNC != 0 {
+		// 既存の内容は破棄されるため、ダウンロードせずに空ファイルから書き始める
+		if errno := file.truncate(0); errno != fusefs.OK {
+			return nil, 0, errno
+		}
+		n.addFile(file)
+		return file, 0, fusefs.OK
+	}
+	n.addFile(file)
+	return file, n.fsys.keepCache(pos), fusefs.OK
+}
+
+// keepCache はETagが前回のOpenから変わっていなければFOPEN_KEEP_CACHEを返し、カーネルのページキャッシュから読ませる。
+// ETagはLookupのキャッシュから取得するため、属性のキャッシュ期間内に他のプロセスが更新した内容は反映されない
+func (f *FileSystem) keepCache(pos Position) uint32 {
+	if !f.opts.KeepCache {
+		return 0
+	}
+
+	obj, err := f.sess.Lookup(pos.Bucket, pos.Key)
+	if err != nil || obj == nil || obj.ETag == nil {
+		return 0
+	}
+
+	k := cacheKey(pos.Bucket, pos.Key)
+	prev, ok := f.openETags.Load(k)
+	f.openETags.Store(k, *obj.ETag)
+	if !ok || prev.(string) != *obj.ETag {
+		return 0 // FOPEN_KEEP_CACHEが無いと、カーネルはページキャッシュを破棄する
+	}
+	return fuse.FOPEN_KEEP_CACHE
+}
+
+// forgetETags はKeepCache用に保持したposとその配下のETagを破棄する。削除やリネームで使われなくなったパスを残さない
+func (f *FileSystem) forgetETags(pos Position) {
+	k := cacheKey(pos.Bucket, pos.Key)
+	f.openETags.Delete(k)
+
+	prefix := k + "/"
+	if pos.Key == "" {
+		prefix = k // バケット
+	}
+	f.openETags.Range(func(key, _ any) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			f.openETags.Delete(key)
+		}
+		return true
+	})
+}
+
+func (n *Node) addFile(file *S3File) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.files == nil {
+		n.files = map[*S3File]struct{}{}
+	}
+	n.files[file] = struct{}{}
+	file.node = n
+	n.fsys.files.Store(file, struct{}{})
+}
+
+func (n *Node) removeFile(file *S3File) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.files, file)
+	n.fsys.files.Delete(file)
+}
+
+// FlushAll は開かれているファイルの書き込みをすべてアップロードする。
+// 遅延アンマウントされたままプロセスを終了する場合など、Releaseを待てないときに使う
+func (n *Node) FlushAll() error {
+	var failed int
+	n.fsys.files.Range(func(k, _ any) bool {
+		if errno := k.(*S3File).Fsync(context.Background(), 0); errno != fusefs.OK {
+			failed++
+		}
+		return true
+	})
+	if failed > 0 {
+		return fmt.Errorf("flush %d files: %w", failed, syscall.EIO)
+	}
+	return nil
+}
+
+// writingFile は書き込み中のファイルを返す。fhが指定されていればそれを優先する
+func (n *Node) writingFile(fh fusefs.FileHandle) *S3File {
+	if file, ok := fh.(*S3File); ok && file.writing() {
+		return file
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for file := range n.files {
+		if file.writing() {
+			return file
+		}
+	}
+	return nil
 }
 
-func (f *FileSystem) Rename(oldName string, newName string, _ *fuse.Context) fuse.Status {
-	log.Println("Rename:", oldName, newName)
+func (n *Node) Rename(ctx context.Context, name string, newParent fusefs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	oldName := n.childName(name)
+	destName := newParent.EmbeddedInode().Operations().(*Node).childName(newName)
+	log.Println("Rename:", oldName, destName)
 
-	pos := Parse(oldName)
-	destPos := Parse(newName)
+	if flags&fusefs.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+
+	pos := n.fsys.parse(oldName)
+	destPos := n.fsys.parse(destName)
 	if pos.IsMountRoot || pos.IsBucketRoot || destPos.IsMountRoot || destPos.IsBucketRoot {
-		return fuse.EPERM
+		return syscall.EPERM
 	}
 
-	if f.sess.Exists(pos.Bucket, pos.Key) {
+	f := n.fsys
+	obj, err := f.sess.Lookup(pos.Bucket, pos.Key)
+	if err != nil {
+		return syscall.EIO
+	}
+	if obj == nil {
+		return syscall.ENOENT
+	}
+
+	if errno := f.checkRenameDest(obj, destPos); errno != fusefs.OK {
+		return errno
+	}
+
+	if !strings.HasSuffix(obj.Key, "/") {
 		if err := f.move(NewMove(pos, destPos)); err != nil {
-			return fuse.EIO
+			return syscall.EIO
 		}
-		return fuse.OK
+		f.inodes.Rename(oldName, destName)
+		f.forgetETags(pos)
+		f.forgetETags(destPos)
+		return fusefs.OK
 	}
 
-	// 完全一致するオブジェクトが存在しない場合、ディレクトリを指定された可能性がある。suffixに区切り文字を付与して検索する
-	list, err := f.sess.List(pos.Bucket, pos.Key+"/")
+	// ディレクトリの場合は、フォルダオブジェクトを含めて配下のオブジェクトをすべて移動する。
+	// キャッシュされた一覧から漏れたオブジェクトが元の場所に残らないよう、S3から取得し直す
+	list, err := f.sess.ListNoCache(pos.Bucket, pos.Key+"/")
 	if err != nil {
-		return fuse.EIO
+		return syscall.EIO
 	}
 
-	if len(list) == 0 {
-		return fuse.ENOENT
+	moves := DirMoves(list, pos, destPos)
+	if err := f.renameDir(pos, destPos, moves); err != nil {
+		log.Println("rename dir:", err)
+		return syscall.EIO
 	}
+	f.inodes.Rename(oldName, destName)
+	f.forgetETags(pos)
+	f.forgetETags(destPos)
+	return fusefs.OK
+}
 
-	moves := make([]Move, 0, len(list))
-	for _, v := range list {
-		moves = append(moves, Move{
-			SourceBucket: pos.Bucket,
-			SourceKey:    v.Key,
-			DestBucket:   destPos.Bucket,
-			DestKey:      strings.Replace(v.Key, pos.Key, destPos.Key, 1),
-		})
+// checkRenameDest は移動先が既にある場合に、rename(2)と同じく上書きできるかを確認する
+func (f *FileSystem) checkRenameDest(obj *S3Object, destPos Position) syscall.Errno {
+	dest, err := f.sess.Lookup(destPos.Bucket, destPos.Key)
+	if err != nil {
+		return syscall.EIO
+	}
+	if dest == nil {
+		return fusefs.OK
 	}
 
-	for _, m := range moves {
-		if err := f.move(m); err != nil {
-			return fuse.EIO
+	isDir, destIsDir := strings.HasSuffix(obj.Key, "/"), strings.HasSuffix(dest.Key, "/")
+	switch {
+	case isDir && !destIsDir:
+		return syscall.ENOTDIR
+	case !isDir && destIsDir:
+		return syscall.EISDIR
+	case destIsDir:
+		empty, err := f.sess.IsEmptyDir(destPos.Bucket, destPos.Key)
+		if err != nil {
+			return syscall.EIO
+		}
+		if !empty {
+			return syscall.ENOTEMPTY
 		}
 	}
-	return fuse.OK
+	return fusefs.OK
 }
 
 func (f *FileSystem) move(m Move) error {
-	get, err := f.sess.Get(m.SourceBucket, m.SourceKey)
-	if err != nil {
-		return err
-	}
-
-	if err := f.sess.PutBytes(m.DestBucket, m.DestKey, get); err != nil {
+	// オブジェクトの本文はマウントプロセスを経由させず、S3上でコピーする
+	if err := f.sess.Copy(m.SourceBucket, m.SourceKey, m.DestBucket, m.DestKey); err != nil {
 		return err
 	}
 
@@ -179,23 +566,25 @@ func (f *FileSystem) move(m Move) error {
 	return nil
 }
 
-func (f *FileSystem) Mkdir(name string, mode uint32, ctx *fuse.Context) fuse.Status {
-	log.Println("Mkdir:", name)
+func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	childName := n.childName(name)
+	log.Println("Mkdir:", childName)
 
-	pos := Parse(name)
+	pos := n.fsys.parse(childName)
+	f := n.fsys
 
 	if pos.IsMountRoot {
-		return fuse.EISDIR // bug?
+		return nil, syscall.EISDIR // bug?
 	}
 
 	if pos.IsBucketRoot {
 		if f.sess.ExistsBucket(pos.Bucket) {
-			return fuse.EPERM // already exists
+			return nil, syscall.EPERM // already exists
 		}
 		if err := f.sess.CreateBucket(f.sess.Region, pos.Bucket); err != nil {
-			return fuse.EIO
+			return nil, syscall.EIO
 		}
-		return fuse.OK
+		return n.lookupCreated(ctx, name, out)
 	}
 
 	// S3は slash / で終わるとフォルダとして判定される
@@ -205,187 +594,252 @@ func (f *FileSystem) Mkdir(name string, mode uint32, ctx *fuse.Context) fuse.Sta
 		dirName = pos.Key + "/"
 	}
 
-	if err := f.sess.PutBytes(pos.Bucket, dirName, []byte{}); err != nil {
+	caller, _ := fuse.FromContext(ctx)
+	if err := f.sess.PutWithMetadata(pos.Bucket, dirName, bytes.NewReader(nil), posixMeta(fuse.S_IFDIR|mode, callerOwner(caller))); err != nil {
 		log.Println("put bytes:", err)
-		return fuse.EIO
+		return nil, syscall.EIO
 	}
 
-	return fuse.OK
+	return n.lookupCreated(ctx, name, out)
+}
+
+// lookupCreated は作成したファイルやディレクトリの属性を取得して子ノードを返す
+func (n *Node) lookupCreated(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if errno := n.fsys.getAttr(n.childName(name), ctx, &out.Attr); errno != fusefs.OK {
+		return nil, errno
+	}
+	return n.newChild(ctx, name, out.Mode), fusefs.OK
 }
 
-func (f *FileSystem) Create(name string, flags uint32, mode uint32, ctx *fuse.Context) (nodefs.File, fuse.Status) {
-	log.Printf("Create name:%s", name)
+func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	childName := n.childName(name)
+	log.Printf("Create name:%s", childName)
+
+	pos := n.fsys.parse(childName)
+	f := n.fsys
 
-	pos := Parse(name)
+	if pos.IsMountRoot || pos.IsBucketRoot {
+		return nil, nil, 0, syscall.EPERM
+	}
 
 	if f.sess.Exists(pos.Bucket, pos.Key) {
-		return nil, fuse.EINVAL
+		return nil, nil, 0, syscall.EINVAL
 	}
 
-	if err := f.sess.PutBytes(pos.Bucket, pos.Key, make([]byte, 0)); err != nil {
-		return nil, fuse.EIO
+	caller, _ := fuse.FromContext(ctx)
+	metadata := posixMeta(fuse.S_IFREG|mode, callerOwner(caller))
+	if err := f.sess.PutWithMetadata(pos.Bucket, pos.Key, bytes.NewReader(nil), metadata); err != nil {
+		return nil, nil, 0, syscall.EIO
 	}
 
+	ch, errno := n.lookupCreated(ctx, name, out)
+	if errno != fusefs.OK {
+		return nil, nil, 0, errno
+	}
+
+	file := f.newFile(pos)
+	file.metadata = metadata
+	file.created = true
+	ch.Operations().(*Node).addFile(file)
+	return ch, file, 0, fusefs.OK
+}
+
+func (f *FileSystem) newFile(pos Position) *S3File {
 	return &S3File{
-		File:   nodefs.NewDevNullFile(),
-		bucket: pos.Bucket,
-		key:    pos.Key,
-		sess:   f.sess,
-	}, fuse.OK
+		bucket:             pos.Bucket,
+		key:                pos.Key,
+		sess:               f.sess,
+		readAhead:          f.opts.ReadAhead,
+		multipartThreshold: f.opts.MultipartThreshold,
+		partSize:           f.opts.PartSize,
+	}
 }
 
-func (f *FileSystem) OpenDir(name string, _ *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
-	pos := Parse(name)
+func (n *Node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	name := n.name()
+	pos := n.fsys.parse(name)
+	f := n.fsys
 
 	log.Printf("OpenDir name:%+v", pos)
 
-	if pos.IsMountRoot {
+	if pos.IsMountRoot && pos.Bucket == "" {
 		buckets, err := f.sess.ListBuckets()
 		if err != nil {
-			return nil, fuse.EIO
+			return nil, syscall.EIO
 		}
 		log.Println("mount root:", buckets)
 
 		entries := make([]fuse.DirEntry, 0, len(buckets))
+		seen := make(map[string]bool)
 		for _, bucketName := range buckets {
+			seen[bucketName] = true
 			entries = append(entries, fuse.DirEntry{
 				Name: bucketName,
-				Ino:  inodeHash(bucketName),
+				Ino:  f.ino(bucketName),
+				Mode: fuse.S_IFDIR,
 			})
 		}
-		return entries, fuse.OK
+		f.retainInodes(name, seen)
+		return fusefs.NewListDirStream(entries), fusefs.OK
 	}
 
-	objKeys, err := f.sess.List(pos.Bucket, pos.Key)
-	if err != nil {
-		return nil, fuse.EIO
-	}
-
-	m := make(map[string]fuse.DirEntry, len(objKeys))
-	for _, obj := range objKeys {
-		dirName := strings.Split(obj.Key, string(filepath.Separator))[0]
-
-		if !pos.IsBucketRoot && strings.HasPrefix(obj.Key, pos.Key) {
-			dirName = NextParentPath(obj.Key, pos.Key)
-		}
-
-		m[dirName] = fuse.DirEntry{
-			Name: dirName,
-			Ino:  inodeHash(path.Join(name, dirName)),
-			Mode: fuse.S_IFDIR | 0755,
-		}
-		continue
+	prefix := ""
+	if pos.Key != "" {
+		prefix = pos.Key + "/"
 	}
+	return f.newDirStream(name, pos.Bucket, prefix), fusefs.OK
+}
 
-	entries := make([]fuse.DirEntry, 0, len(objKeys))
-	for _, v := range m {
-		entries = append(entries, v)
+// retainInodes は一覧から消えたエントリの番号を破棄する
+func (f *FileSystem) retainInodes(name string, seen map[string]bool) {
+	if f.opts.ClientInodes {
+		f.inodes.Retain(name, seen)
 	}
-	return entries, fuse.OK
 }
 
-func (f *FileSystem) Access(name string, mode uint32, _ *fuse.Context) (code fuse.Status) {
+func (n *Node) Access(ctx context.Context, mask uint32) syscall.Errno {
+	name := n.name()
 	log.Printf("Access pos:%+v\n", name)
 
-	pos := Parse(name)
+	pos := n.fsys.parse(name)
+	f := n.fsys
 
 	if pos.IsMountRoot {
-		return fuse.OK
+		return fusefs.OK
 	}
 
 	if pos.IsBucketRoot {
 		log.Println("is bucket root")
 		if f.sess.ExistsBucket(pos.Bucket) {
-			return fuse.OK
+			return fusefs.OK
 		}
-		return fuse.ENOENT
+		return syscall.ENOENT
 	}
 
-	list, err := f.sess.List(pos.Bucket, pos.Key)
+	// https://github.com/ma91n/localstackmount/issues/9
+	// prefixに一致するファイルが存在するが、要素の部分一致である場合は存在しないディレクトリとして扱う
+	obj, err := f.sess.Lookup(pos.Bucket, pos.Key)
 	if err != nil {
-		return fuse.EIO
+		return syscall.EIO
 	}
-	if len(list) > 0 {
-		// https://github.com/ma91n/localstackmount/issues/9
-		// prefixに一致するファイルが存在するが、要素の部分一致である場合は存在しないディレクトリとして扱いたい
-
-		return fuse.OK
+	if obj != nil {
+		return fusefs.OK
 	}
 
-	return fuse.ENOENT
+	return syscall.ENOENT
 }
 
-func (f *FileSystem) Unlink(name string, _ *fuse.Context) (code fuse.Status) {
-	pos := Parse(name)
+func (n *Node) Unlink(ctx context.Context, name string) syscall.Errno {
+	childName := n.childName(name)
+	pos := n.fsys.parse(childName)
 	log.Printf("Unlink pos:%+v\n", pos)
 
+	f := n.fsys
 	if !f.sess.Exists(pos.Bucket, pos.Key) {
-		return fuse.ENOENT
+		return syscall.ENOENT
 	}
 
 	if err := f.sess.Delete(pos.Bucket, pos.Key); err != nil {
-		return fuse.EIO
+		return syscall.EIO
 	}
-	return fuse.OK
+	f.inodes.Remove(childName)
+	f.forgetETags(pos)
+	return fusefs.OK
 }
 
-func (f *FileSystem) Rmdir(name string, ctx *fuse.Context) (code fuse.Status) {
-	pos := Parse(name)
+func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	childName := n.childName(name)
+	pos := n.fsys.parse(childName)
 	log.Printf("Rmdir pos:%+v\n", pos)
 
+	f := n.fsys
+
 	if pos.IsMountRoot {
-		return fuse.EPERM
+		return syscall.EPERM
 	}
 
 	if pos.IsBucketRoot {
 		if !f.sess.ExistsBucket(pos.Bucket) {
-			return fuse.ENOENT
+			return syscall.ENOENT
 		}
 		if err := f.sess.DeleteBucket(pos.Bucket); err != nil {
-			return fuse.EIO
+			return syscall.EIO
 		}
-		return fuse.OK
+		f.inodes.Remove(childName)
+		f.forgetETags(pos)
+		return fusefs.OK
 	}
 
-	if !strings.HasSuffix(name, "/") {
-		pos.Key = pos.Key + "/"
-	}
+	dirPos := pos
+	pos.Key = pos.Key + "/"
 
 	if !f.sess.Exists(pos.Bucket, pos.Key) {
-		return fuse.ENOENT
+		return syscall.ENOENT
 	}
 
 	if err := f.sess.Delete(pos.Bucket, pos.Key); err != nil {
-		return fuse.EIO
+		return syscall.EIO
 	}
-	return fuse.OK
+	f.inodes.Remove(childName)
+	f.forgetETags(dirPos)
+	return fusefs.OK
 }
 
-func (f *FileSystem) Utimens(name string, Atime *time.Time, Mtime *time.Time, ctx *fuse.Context) (code fuse.Status) {
-	pos := Parse(name)
-	log.Println("Utimens pos:", pos)
+func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	pos := n.fsys.parse(n.childName(name))
+	log.Printf("Symlink pos:%+v value:%s\n", pos, target)
 
-	if f.sess.Exists(pos.Bucket, pos.Key) {
-		return fuse.OK // TODO S3上のメタファイルを書き換え？
+	if pos.IsMountRoot || pos.IsBucketRoot {
+		return nil, syscall.EPERM
+	}
+
+	f := n.fsys
+	obj, err := f.sess.Lookup(pos.Bucket, pos.Key)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	if obj != nil {
+		return nil, syscall.EEXIST
+	}
 
+	// シンボリックリンクはリンク先をメタデータに持つ空のオブジェクトとして保存する
+	caller, _ := fuse.FromContext(ctx)
+	metadata := posixMeta(fuse.S_IFLNK|0777, callerOwner(caller))
+	metadata[metaSymlinkTarget] = aws.String(escapeMeta(target))
+	if err := f.sess.PutWithMetadata(pos.Bucket, pos.Key, bytes.NewReader(nil), metadata); err != nil {
+		log.Println("put symlink:", err)
+		return nil, syscall.EIO
 	}
-	return fuse.ENOENT
+	return n.lookupCreated(ctx, name, out)
 }
 
-func (f *FileSystem) String() string {
-	return "localstackmount"
+func (n *Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	pos := n.fsys.parse(n.name())
+	log.Printf("Readlink pos:%+v\n", pos)
+
+	obj, err := n.fsys.sess.Stat(pos.Bucket, pos.Key)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	if obj == nil {
+		return nil, syscall.ENOENT
+	}
+
+	target, ok := symlinkTarget(obj.Metadata)
+	if !ok {
+		return nil, syscall.EINVAL // シンボリックリンクではない
+	}
+	return []byte(target), fusefs.OK
 }
 
-func inodeHash(o string) uint64 {
-	h := fnv.New64a()
-	_, _ = h.Write([]byte(o))
-	return h.Sum64()
+// callerOwner は作成したファイルの所有者にする呼び出し元のuid, gidを返す
+func callerOwner(caller *fuse.Caller) fuse.Owner {
+	if caller == nil {
+		return fuse.Owner{}
+	}
+	return caller.Owner
 }
 
 func keyGen(input []byte) string {
 	return fmt.Sprintf("%x", murmur3.Sum64(input))
 }
-
-func rootKey() string {
-	return keyGen([]byte("localstackmount"))
-}
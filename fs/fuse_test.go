@@ -0,0 +1,406 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestRoot はマウントせずにノードの親子関係を使えるマウントルートを返す
+func newTestRoot(t *testing.T, sess *S3Session, opts Options) *Node {
+	t.Helper()
+
+	root := NewFileSystem(sess, opts)
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	return root
+}
+
+// lookupPath はnameをたどってノードを返す
+func lookupPath(t *testing.T, n *Node, names ...string) *Node {
+	t.Helper()
+
+	for _, name := range names {
+		var out fuse.EntryOut
+		ch, errno := n.Lookup(context.Background(), name, &out)
+		if errno != fusefs.OK {
+			t.Fatalf("Lookup(%s) = %v", name, errno)
+		}
+		n.AddChild(name, ch, true)
+		n = ch.Operations().(*Node)
+	}
+	return n
+}
+
+func TestNode_SetattrSize(t *testing.T) {
+	tests := []struct {
+		name string
+		open bool
+		size uint64
+		want []byte
+	}{
+		{name: "shrink", size: 5, want: []byte("hello")},
+		{name: "extend", size: 13, want: []byte("hello world\x00\x00")},
+		{name: "empty", size: 0, want: []byte{}},
+		{name: "shrink opened file", open: true, size: 5, want: []byte("hello")},
+		{name: "extend opened file", open: true, size: 13, want: []byte("hello world\x00\x00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := newTestSession(t, S3Options{})
+			if err := sess.PutBytes(testBucket, "a.txt", []byte("hello world")); err != nil {
+				t.Fatal(err)
+			}
+			n := lookupPath(t, newTestRoot(t, sess, Options{}), testBucket, "a.txt")
+
+			var fh fusefs.FileHandle
+			if tt.open {
+				var errno syscall.Errno
+				fh, _, errno = n.Open(context.Background(), syscall.O_RDWR)
+				if errno != fusefs.OK {
+					t.Fatalf("Open() = %v", errno)
+				}
+			}
+
+			in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: tt.size}}
+			var out fuse.AttrOut
+			if errno := n.Setattr(context.Background(), fh, in, &out); errno != fusefs.OK {
+				t.Fatalf("Setattr() = %v", errno)
+			}
+			if out.Size != tt.size {
+				t.Errorf("Setattr() size = %d, want %d", out.Size, tt.size)
+			}
+
+			if fh != nil {
+				if errno := fh.(*S3File).Flush(context.Background()); errno != fusefs.OK {
+					t.Fatalf("Flush() = %v", errno)
+				}
+			}
+			got, err := getObject(sess, testBucket, "a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("object = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func readdirNames(t *testing.T, n *Node) []string {
+	t.Helper()
+
+	stream, errno := n.Readdir(context.Background())
+	if errno != fusefs.OK {
+		t.Fatalf("Readdir() = %v", errno)
+	}
+	var names []string
+	for stream.HasNext() {
+		e, errno := stream.Next()
+		if errno != fusefs.OK {
+			t.Fatalf("Next() = %v", errno)
+		}
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestNode_operations(t *testing.T) {
+	ctx := context.Background()
+	sess := newTestSession(t, S3Options{})
+	if err := sess.PutBytes(testBucket, "dir/keep.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	root := newTestRoot(t, sess, Options{ClientInodes: true})
+	dir := lookupPath(t, root, testBucket, "dir")
+
+	var out fuse.EntryOut
+	ch, fh, _, errno := dir.Create(ctx, "a.txt", syscall.O_WRONLY, 0644, &out)
+	if errno != fusefs.OK {
+		t.Fatalf("Create() = %v", errno)
+	}
+	if out.Mode != fuse.S_IFREG|0644 {
+		t.Errorf("Create() mode = %o, want %o", out.Mode, fuse.S_IFREG|0644)
+	}
+	dir.AddChild("a.txt", ch, true)
+	file := fh.(*S3File)
+	if _, errno := file.Write(ctx, []byte("hello"), 0); errno != fusefs.OK {
+		t.Fatalf("Write() = %v", errno)
+	}
+
+	// 書き込み中はS3ではなく一時ファイルの属性を返す
+	var attr fuse.AttrOut
+	if errno := ch.Operations().(*Node).Getattr(ctx, nil, &attr); errno != fusefs.OK || attr.Size != 5 {
+		t.Errorf("Getattr() while writing = %d, %v, want 5", attr.Size, errno)
+	}
+	if errno := file.Flush(ctx); errno != fusefs.OK {
+		t.Fatalf("Flush() = %v", errno)
+	}
+	file.Release(ctx)
+
+	if got := readdirNames(t, dir); len(got) != 2 || got[0] != "a.txt" || got[1] != "keep.txt" {
+		t.Errorf("Readdir() = %v, want [a.txt keep.txt]", got)
+	}
+
+	if errno := dir.Rename(ctx, "a.txt", dir, "b.txt", fusefs.RENAME_EXCHANGE); errno != syscall.ENOTSUP {
+		t.Errorf("Rename(RENAME_EXCHANGE) = %v, want ENOTSUP", errno)
+	}
+	if errno := dir.Rename(ctx, "a.txt", dir, "b.txt", 0); errno != fusefs.OK {
+		t.Fatalf("Rename() = %v", errno)
+	}
+	if got, err := getObject(sess, testBucket, "dir/b.txt"); err != nil || string(got) != "hello" {
+		t.Errorf("renamed object = %q, %v, want hello", got, err)
+	}
+	if _, errno := dir.Lookup(ctx, "a.txt", &out); errno != syscall.ENOENT {
+		t.Errorf("Lookup(a.txt) after rename = %v, want ENOENT", errno)
+	}
+
+	if errno := dir.Unlink(ctx, "b.txt"); errno != fusefs.OK {
+		t.Fatalf("Unlink() = %v", errno)
+	}
+	if got := readdirNames(t, dir); len(got) != 1 || got[0] != "keep.txt" {
+		t.Errorf("Readdir() after unlink = %v, want [keep.txt]", got)
+	}
+}
+
+func TestNode_Symlink(t *testing.T) {
+	ctx := context.Background()
+	c := &requestCounter{}
+	sess := newTestSessionWith(t, S3Options{CacheTTL: CacheTTL{Attr: time.Minute}}, c.wrap)
+	if err := sess.PutBytes(testBucket, "dir/empty.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	dir := lookupPath(t, newTestRoot(t, sess, Options{}), testBucket, "dir")
+
+	target := "../データ/ファイル.txt"
+	var out fuse.EntryOut
+	ch, errno := dir.Symlink(ctx, target, "link", &out)
+	if errno != fusefs.OK {
+		t.Fatalf("Symlink() = %v", errno)
+	}
+	if out.Mode&syscall.S_IFMT != syscall.S_IFLNK || out.Size != uint64(len(target)) {
+		t.Errorf("Symlink() mode = %o size = %d, want symlink of size %d", out.Mode, out.Size, len(target))
+	}
+	dir.AddChild("link", ch, true)
+	if got, errno := ch.Operations().(*Node).Readlink(ctx); errno != fusefs.OK || string(got) != target {
+		t.Errorf("Readlink() = %q, %v, want %q", got, errno, target)
+	}
+	if _, errno := lookupPath(t, dir, "empty.txt").Readlink(ctx); errno != syscall.EINVAL {
+		t.Errorf("Readlink(empty.txt) = %v, want EINVAL", errno)
+	}
+
+	// 空のオブジェクトはReaddirでHeadObjectせず、HeadObject済みのメタデータから種類を決める。
+	// まだstatしていないものは通常のファイルとする
+	if err := sess.PutBytes(testBucket, "dir/unknown.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	heads := c.count(http.MethodHead)
+	stream, errno := dir.Readdir(ctx)
+	if errno != fusefs.OK {
+		t.Fatalf("Readdir() = %v", errno)
+	}
+	want := map[string]uint32{"link": syscall.S_IFLNK, "empty.txt": syscall.S_IFREG, "unknown.txt": syscall.S_IFREG}
+	for stream.HasNext() {
+		e, _ := stream.Next()
+		if got := e.Mode & syscall.S_IFMT; got != want[e.Name] {
+			t.Errorf("Readdir() %s type = %o, want %o", e.Name, got, want[e.Name])
+		}
+	}
+	if got := c.count(http.MethodHead) - heads; got != 0 {
+		t.Errorf("HEAD in Readdir = %d, want 0", got)
+	}
+
+	var attr fuse.EntryOut
+	if _, errno := dir.Lookup(ctx, "link", &attr); errno != fusefs.OK || attr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		t.Errorf("Lookup(link) mode = %o, %v, want symlink", attr.Mode, errno)
+	}
+}
+
+func TestNode_RenameDir(t *testing.T) {
+	ctx := context.Background()
+	sess := newTestSession(t, S3Options{CacheTTL: CacheTTL{List: time.Minute, Attr: time.Minute}})
+	for _, key := range []string{"src/a.txt", "full/x.txt", "file.txt"} {
+		if err := sess.PutBytes(testBucket, key, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := listDir(sess, testBucket, "src/"); err != nil {
+		t.Fatal(err)
+	}
+	// キャッシュを無効化せずに追加し、キャッシュされた一覧を古くする
+	if _, err := sess.svc.PutObject(&s3.PutObjectInput{Bucket: aws.String(testBucket), Key: aws.String("src/b.txt"), Body: strings.NewReader("hello")}); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := lookupPath(t, newTestRoot(t, sess, Options{}), testBucket)
+	for _, name := range []string{"src", "full", "file.txt"} {
+		lookupPath(t, bucket, name)
+	}
+
+	tests := []struct {
+		name    string
+		oldName string
+		newName string
+		want    syscall.Errno
+	}{
+		{name: "over non-empty directory", oldName: "src", newName: "full", want: syscall.ENOTEMPTY},
+		{name: "directory over file", oldName: "src", newName: "file.txt", want: syscall.ENOTDIR},
+		{name: "file over directory", oldName: "file.txt", newName: "full", want: syscall.EISDIR},
+		{name: "directory", oldName: "src", newName: "dst", want: fusefs.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errno := bucket.Rename(ctx, tt.oldName, bucket, tt.newName, 0); errno != tt.want {
+				t.Errorf("Rename(%s, %s) = %v, want %v", tt.oldName, tt.newName, errno, tt.want)
+			}
+		})
+	}
+
+	list, err := sess.ListNoCache(testBucket, "dst/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Key != "dst/a.txt" || list[1].Key != "dst/b.txt" {
+		t.Errorf("ListNoCache(dst/) = %v, want dst/a.txt and dst/b.txt", list)
+	}
+	if list, err := sess.ListNoCache(testBucket, "src/"); err != nil || len(list) != 0 {
+		t.Errorf("ListNoCache(src/) = %v, %v, want empty", list, err)
+	}
+}
+
+func TestFileSystem_forgetETags(t *testing.T) {
+	tests := []struct {
+		name string
+		pos  Position
+		want []string
+	}{
+		{name: "file", pos: Parse("bucket/dir/a.txt"), want: []string{"bucket:dir/b.txt", "bucket:dir2/c.txt", "other:dir/a.txt"}},
+		{name: "directory", pos: Parse("bucket/dir"), want: []string{"bucket:dir2/c.txt", "other:dir/a.txt"}},
+		{name: "bucket", pos: Parse("bucket"), want: []string{"other:dir/a.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FileSystem{}
+			for _, k := range []string{"bucket:dir/a.txt", "bucket:dir/b.txt", "bucket:dir2/c.txt", "other:dir/a.txt"} {
+				f.openETags.Store(k, `"etag"`)
+			}
+			f.forgetETags(tt.pos)
+
+			var got []string
+			f.openETags.Range(func(k, _ any) bool {
+				got = append(got, k.(string))
+				return true
+			})
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("openETags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNode_ReaddirPages(t *testing.T) {
+	c := &requestCounter{}
+	sess := newTestSessionWith(t, S3Options{}, c.wrap)
+	for i := 0; i < 1001; i++ {
+		if err := sess.PutBytes(testBucket, fmt.Sprintf("dir/%04d.txt", i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := lookupPath(t, newTestRoot(t, sess, Options{}), testBucket, "dir")
+	lists := c.count(http.MethodGet)
+
+	// 1ページ目を取得した時点でエントリを返し始める
+	stream, errno := dir.Readdir(context.Background())
+	if errno != fusefs.OK {
+		t.Fatalf("Readdir() = %v", errno)
+	}
+	if got := c.count(http.MethodGet) - lists; got != 0 {
+		t.Errorf("requests before HasNext = %d, want 0", got)
+	}
+	if !stream.HasNext() {
+		t.Fatal("HasNext() = false")
+	}
+	if got := c.count(http.MethodGet) - lists; got != 1 {
+		t.Errorf("requests after the first HasNext = %d, want 1", got)
+	}
+
+	var n int
+	for ; stream.HasNext(); n++ {
+		if _, errno := stream.Next(); errno != fusefs.OK {
+			t.Fatalf("Next() = %v", errno)
+		}
+	}
+	if n != 1001 {
+		t.Errorf("entries = %d, want 1001", n)
+	}
+	if got := c.count(http.MethodGet) - lists; got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+}
+
+func TestNode_OpenKeepCache(t *testing.T) {
+	ctx := context.Background()
+	sess := newTestSession(t, S3Options{CacheTTL: CacheTTL{Attr: time.Minute}})
+	if err := sess.PutBytes(testBucket, "a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	n := lookupPath(t, newTestRoot(t, sess, Options{KeepCache: true}), testBucket, "a.txt")
+
+	open := func(flags uint32) (*S3File, uint32) {
+		t.Helper()
+		fh, fuseFlags, errno := n.Open(ctx, flags)
+		if errno != fusefs.OK {
+			t.Fatalf("Open() = %v", errno)
+		}
+		return fh.(*S3File), fuseFlags
+	}
+	wantKeep := func(step string, got, want uint32) {
+		t.Helper()
+		if got&fuse.FOPEN_KEEP_CACHE != want {
+			t.Errorf("Open() %s flags = %#x, want FOPEN_KEEP_CACHE %#x", step, got, want)
+		}
+	}
+
+	// 初回はページキャッシュが無いため破棄させ、ETagが変わらなければ残す
+	file, flags := open(syscall.O_RDONLY)
+	file.Release(ctx)
+	wantKeep("first", flags, 0)
+	file, flags = open(syscall.O_RDONLY)
+	file.Release(ctx)
+	wantKeep("unchanged", flags, fuse.FOPEN_KEEP_CACHE)
+
+	// マウント経由で書き込むとETagが変わるため、次のOpenではページキャッシュを破棄させる
+	file, _ = open(syscall.O_RDWR)
+	if _, errno := file.Write(ctx, []byte("HELLO"), 0); errno != fusefs.OK {
+		t.Fatalf("Write() = %v", errno)
+	}
+	if errno := file.Flush(ctx); errno != fusefs.OK {
+		t.Fatalf("Flush() = %v", errno)
+	}
+	file.Release(ctx)
+	file, flags = open(syscall.O_RDONLY)
+	file.Release(ctx)
+	wantKeep("after write", flags, 0)
+	file, flags = open(syscall.O_RDONLY)
+	file.Release(ctx)
+	wantKeep("unchanged after write", flags, fuse.FOPEN_KEEP_CACHE)
+
+	// マウントを経由せずにS3Sessionで更新した場合も、属性のキャッシュが破棄されていれば同じ
+	if err := sess.PutBytes(testBucket, "a.txt", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	file, flags = open(syscall.O_RDONLY)
+	file.Release(ctx)
+	wantKeep("after external update", flags, 0)
+}
@@ -0,0 +1,227 @@
+package fs
+
+import (
+	"strings"
+	"sync"
+)
+
+// RootIno はマウントルートのinode番号。FUSEではルートは1と決まっている
+const RootIno = 1
+
+// InodeTable はマウントルートからのパス(bucket/key)ごとにinode番号を割り当てる。
+// パスのハッシュと違って衝突せず、リネームしても同じ番号を引き継ぐ。
+// 番号は再利用しない。削除したパスやカーネルが忘れたパスのエントリは破棄し、次は新しい番号を割り当てる。
+// 同じ番号が別のファイルを指すことが無いため、NFSエクスポートなどで古いハンドルを見分けるための世代番号(StableAttr.Gen)は使わない
+type InodeTable struct {
+	mu   sync.Mutex
+	next uint64
+	root *inodeEntry
+	// entries inode番号からエントリを引く。ツリーから外れたエントリもカーネルが忘れるまではここに残す
+	entries map[uint64]*inodeEntry
+}
+
+// inodeEntry はパスの1要素。ディレクトリごとに子を持ち、リネームや削除は配下を辿るだけで済む
+type inodeEntry struct {
+	ino      uint64
+	name     string
+	parent   *inodeEntry
+	children map[string]*inodeEntry
+	// referenced カーネルがinodeとして参照している。falseの場合はReaddirで番号を返しただけ
+	referenced bool
+}
+
+func NewInodeTable() *InodeTable {
+	root := &inodeEntry{ino: RootIno, referenced: true}
+	return &InodeTable{
+		next:    RootIno + 1,
+		root:    root,
+		entries: map[uint64]*inodeEntry{RootIno: root},
+	}
+}
+
+// Get はパスのinode番号を返す。まだ割り当てていなければ割り当てる
+func (t *InodeTable) Get(name string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.lookup(name, true).ino
+}
+
+// Ref はパスのinode番号を返し、カーネルが参照しているものとして記録する。Forgetされるまで破棄しない
+func (t *InodeTable) Ref(name string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.lookup(name, true)
+	e.referenced = true
+	return e.ino
+}
+
+// Forget はカーネルがinodeを忘れたことを記録し、参照されていないエントリを破棄する
+func (t *InodeTable) Forget(ino uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[ino]
+	if !ok || e == t.root {
+		return
+	}
+	e.referenced = false
+	if !t.attached(e) {
+		// 削除やリネームの上書きでツリーから外れている
+		t.drop(e)
+		return
+	}
+	for _, ch := range e.children {
+		t.prune(ch)
+	}
+	for e != t.root && !e.referenced && len(e.children) == 0 {
+		parent := e.parent
+		t.detach(e)
+		t.drop(e)
+		e = parent
+	}
+}
+
+// Retain はディレクトリの子のうち、namesに含まれず参照もされていないエントリを破棄する。
+// Readdirで番号を返しただけのエントリが、一覧から消えた後も残り続けないようにする
+func (t *InodeTable) Retain(dir string, names map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.lookup(dir, false)
+	if e == nil {
+		return
+	}
+	for name, ch := range e.children {
+		if !names[name] {
+			t.prune(ch)
+		}
+	}
+}
+
+// Rename はoldNameとその配下のパスの番号をnewNameに付け替える。newNameに割り当て済みの番号は破棄する
+func (t *InodeTable) Rename(oldName, newName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remove(newName)
+
+	e := t.lookup(oldName, false)
+	if e == nil || e == t.root {
+		return
+	}
+	t.detach(e)
+	dir, base := splitName(newName)
+	parent := t.lookup(dir, true)
+	e.name = base
+	e.parent = parent
+	if parent.children == nil {
+		parent.children = map[string]*inodeEntry{}
+	}
+	parent.children[base] = e
+}
+
+// Remove はnameとその配下のパスの番号を破棄する。カーネルが参照しているものはForgetまで番号を引けるように残す
+func (t *InodeTable) Remove(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remove(name)
+}
+
+// Len は保持しているエントリ数を返す
+func (t *InodeTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.entries)
+}
+
+func (t *InodeTable) remove(name string) {
+	e := t.lookup(name, false)
+	if e == nil || e == t.root {
+		return
+	}
+	t.detach(e)
+	t.dropUnreferenced(e)
+}
+
+// lookup はパスのエントリを返す。createがtrueの場合は途中のエントリも含めて作る
+func (t *InodeTable) lookup(name string, create bool) *inodeEntry {
+	e := t.root
+	if name == "" {
+		return e
+	}
+	for _, elem := range strings.Split(name, "/") {
+		ch, ok := e.children[elem]
+		if !ok {
+			if !create {
+				return nil
+			}
+			ch = &inodeEntry{ino: t.next, name: elem, parent: e}
+			t.next++
+			if e.children == nil {
+				e.children = map[string]*inodeEntry{}
+			}
+			e.children[elem] = ch
+			t.entries[ch.ino] = ch
+		}
+		e = ch
+	}
+	return e
+}
+
+// attached はエントリがルートから辿れるかを返す
+func (t *InodeTable) attached(e *inodeEntry) bool {
+	for ; e != nil; e = e.parent {
+		if e == t.root {
+			return true
+		}
+	}
+	return false
+}
+
+// detach はエントリを親から外す
+func (t *InodeTable) detach(e *inodeEntry) {
+	if e.parent != nil {
+		delete(e.parent.children, e.name)
+		e.parent = nil
+	}
+}
+
+// drop はツリーから外れたエントリと配下を破棄する
+func (t *InodeTable) drop(e *inodeEntry) {
+	delete(t.entries, e.ino)
+	for _, ch := range e.children {
+		t.drop(ch)
+	}
+}
+
+// dropUnreferenced はツリーから外れたエントリと配下のうち、参照されていないものを破棄する
+func (t *InodeTable) dropUnreferenced(e *inodeEntry) {
+	for _, ch := range e.children {
+		t.dropUnreferenced(ch)
+	}
+	if !e.referenced {
+		delete(t.entries, e.ino)
+	}
+}
+
+// prune は参照されているエントリを含まない部分木を破棄する
+func (t *InodeTable) prune(e *inodeEntry) {
+	for _, ch := range e.children {
+		t.prune(ch)
+	}
+	if !e.referenced && len(e.children) == 0 {
+		t.detach(e)
+		delete(t.entries, e.ino)
+	}
+}
+
+func splitName(name string) (dir, base string) {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
@@ -0,0 +1,137 @@
+package fs
+
+import "testing"
+
+func TestInodeTable(t *testing.T) {
+	table := NewInodeTable()
+
+	if got := table.Get(""); got != RootIno {
+		t.Errorf("root ino = %d, want %d", got, RootIno)
+	}
+
+	dir := table.Ref("bucket/dir")
+	file := table.Ref("bucket/dir/file.txt")
+	if dir == file {
+		t.Fatalf("inode collision: %d", dir)
+	}
+	if got := table.Get("bucket/dir/file.txt"); got != file {
+		t.Errorf("Get() = %d, want %d", got, file)
+	}
+
+	// リネームしても番号は変わらない
+	table.Rename("bucket/dir", "bucket/renamed")
+	if got := table.Get("bucket/renamed"); got != dir {
+		t.Errorf("renamed dir = %d, want %d", got, dir)
+	}
+	if got := table.Get("bucket/renamed/file.txt"); got != file {
+		t.Errorf("renamed file = %d, want %d", got, file)
+	}
+	if got := table.Get("bucket/dir"); got == dir {
+		t.Errorf("old path should get a new inode: %d", got)
+	}
+
+	// 削除された番号は再利用しない
+	table.Remove("bucket/renamed/file.txt")
+	if got := table.Get("bucket/renamed/file.txt"); got == file {
+		t.Errorf("removed inode %d was reused", file)
+	}
+	if got := table.Get("bucket/other.txt"); got == file {
+		t.Errorf("removed inode %d was reused", file)
+	}
+
+	// カーネルが忘れた番号も再利用しないため、世代番号が無くても古いinodeと区別できる
+	forgotten := table.Ref("bucket/forgotten.txt")
+	table.Forget(forgotten)
+	if got := table.Ref("bucket/forgotten.txt"); got == forgotten {
+		t.Errorf("forgotten inode %d was reused", forgotten)
+	}
+}
+
+func TestInodeTable_Forget(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(table *InodeTable)
+		want int
+	}{
+		{
+			name: "readdir only entries are dropped with the directory",
+			run: func(table *InodeTable) {
+				dir := table.Ref("bucket/dir")
+				table.Get("bucket/dir/a.txt")
+				table.Get("bucket/dir/b.txt")
+				table.Forget(dir)
+			},
+			want: 1,
+		},
+		{
+			name: "referenced children keep the directory",
+			run: func(table *InodeTable) {
+				dir := table.Ref("bucket/dir")
+				table.Ref("bucket/dir/a.txt")
+				table.Get("bucket/dir/b.txt")
+				table.Forget(dir)
+			},
+			want: 4,
+		},
+		{
+			name: "forgetting the last child drops unreferenced parents",
+			run: func(table *InodeTable) {
+				file := table.Ref("bucket/dir/a.txt")
+				table.Forget(file)
+			},
+			want: 1,
+		},
+		{
+			name: "removed entry is kept until forgotten",
+			run: func(table *InodeTable) {
+				file := table.Ref("bucket/a.txt")
+				table.Remove("bucket/a.txt")
+				if got := table.Len(); got != 3 {
+					t.Errorf("Len() before forget = %d, want 3", got)
+				}
+				table.Forget(file)
+			},
+			want: 2,
+		},
+		{
+			name: "overwritten by rename",
+			run: func(table *InodeTable) {
+				src := table.Ref("bucket/src.txt")
+				dst := table.Ref("bucket/dst.txt")
+				table.Rename("bucket/src.txt", "bucket/dst.txt")
+				table.Forget(dst)
+				if got := table.Get("bucket/dst.txt"); got != src {
+					t.Errorf("dst ino = %d, want %d", got, src)
+				}
+			},
+			want: 3,
+		},
+		{
+			name: "retain drops entries that disappeared from the listing",
+			run: func(table *InodeTable) {
+				table.Ref("bucket")
+				table.Get("bucket/a.txt")
+				table.Get("bucket/b.txt")
+				table.Ref("bucket/c.txt")
+				table.Retain("bucket", map[string]bool{"a.txt": true})
+			},
+			want: 4,
+		},
+		{
+			name: "root is never forgotten",
+			run: func(table *InodeTable) {
+				table.Forget(RootIno)
+			},
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := NewInodeTable()
+			tt.run(table)
+			if got := table.Len(); got != tt.want {
+				t.Errorf("Len() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+const journalExt = ".jsonl"
+
+// errJournalLocked は他のリネームか別のプロセスがジャーナルを使用中
+var errJournalLocked = errors.New("journal is locked")
+
+// RenameJournal はディレクトリのリネームで予定しているMoveと、その完了状況を記録する。
+// 1行目に予定しているMoveの一覧、2行目以降に完了したMoveの番号とリトライ時に追加したMoveを追記していくため、途中でプロセスが落ちても再開できる。
+// 開いている間はファイルをflockし、実行中のリネームを他のマウントの復旧が読み込まないようにする
+type RenameJournal struct {
+	// Endpoint 同じジャーナルディレクトリを別のエンドポイントのマウントと共有しても、自分のリネームだけを復旧する
+	Endpoint string `json:"endpoint,omitempty"`
+	Source   string `json:"source"`
+	Dest     string `json:"dest"`
+	Moves    []Move `json:"moves"`
+	done     []bool
+	path     string
+	file     *os.File
+	mu       sync.Mutex
+
+	// resumed 中断されたジャーナルを読み込んだ場合はtrue
+	resumed bool
+}
+
+// journalLine はジャーナルの2行目以降。完了したMoveの番号か、リトライで追加したMoveのどちらか
+type journalLine struct {
+	Done  *int   `json:"done,omitempty"`
+	Moves []Move `json:"moves,omitempty"`
+}
+
+// OpenRenameJournal はendpointのsourceからdestへのリネームのジャーナルを開く。
+// 中断された同じリネームのジャーナルが残っていればそれを再開し、movesのうち記録されていないものを追加する。
+// dirが空の場合はファイルに記録しない
+func OpenRenameJournal(dir, endpoint string, source, dest Position, moves []Move) (*RenameJournal, error) {
+	j := &RenameJournal{
+		Endpoint: endpoint,
+		Source:   source.Bucket + "/" + source.Key,
+		Dest:     dest.Bucket + "/" + dest.Key,
+		Moves:    moves,
+		done:     make([]bool, len(moves)),
+	}
+	if dir == "" {
+		return j, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create journal dir: %w", err)
+	}
+	j.path = filepath.Join(dir, keyGen([]byte(j.Endpoint+"\x00"+j.Source+"\x00"+j.Dest))+journalExt)
+
+	if _, err := os.Stat(j.path); err == nil {
+		// 前回失敗したリネームのリトライ。前回のリスト以降に作られたオブジェクトも移動する
+		resumed, err := loadRenameJournal(j.path)
+		if err == nil {
+			if err := resumed.add(moves); err != nil {
+				_ = resumed.Close()
+				return nil, err
+			}
+			return resumed, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		// ロックを待つ間に完了したリネームのジャーナルは削除済みなので、新しく作る
+	}
+
+	// ヘッダを書き込むまで復旧に読み込まれないよう、ロックした一時ファイルに書いてから置き換える
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("create journal: %w", err)
+	}
+	if err := lockJournal(file); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+	j.file = file
+
+	if err := j.append(j); err != nil {
+		_ = j.Close()
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		_ = j.Close()
+		_ = os.Remove(tmp)
+		return nil, fmt.Errorf("create journal: %w", err)
+	}
+	return j, nil
+}
+
+// lockJournal はジャーナルを排他ロックする。他で使用中の場合は待たずにerrJournalLockedを返す
+func lockJournal(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("%s: %w", file.Name(), errJournalLocked)
+		}
+		return fmt.Errorf("lock journal: %w", err)
+	}
+	return nil
+}
+
+// LoadRenameJournals はdirに残っている中断されたリネームのジャーナルを読み込む。
+// 実行中のリネームのジャーナルはロックされているため読み込まない
+func LoadRenameJournals(dir string) ([]*RenameJournal, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+journalExt))
+	if err != nil {
+		return nil, fmt.Errorf("glob journal: %w", err)
+	}
+
+	resp := make([]*RenameJournal, 0, len(paths))
+	for _, p := range paths {
+		j, err := loadRenameJournal(p)
+		if errors.Is(err, errJournalLocked) || errors.Is(err, os.ErrNotExist) {
+			continue // 実行中か、その間に完了したリネーム
+		}
+		if err != nil {
+			for _, v := range resp {
+				_ = v.Close()
+			}
+			return nil, err
+		}
+		resp = append(resp, j)
+	}
+	return resp, nil
+}
+
+func loadRenameJournal(path string) (*RenameJournal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	if err := lockJournal(file); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	// ロックする前に削除されていれば、そのリネームは完了している
+	if err := sameJournal(file, path); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	j := &RenameJournal{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<30)
+
+	if !scanner.Scan() {
+		_ = file.Close()
+		return nil, fmt.Errorf("journal %s has no header", path)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), j); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("parse journal header: %w", err)
+	}
+	j.done = make([]bool, len(j.Moves))
+
+	for scanner.Scan() {
+		var line journalLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			break // 書き込み途中で落ちた行は未完了として扱う
+		}
+		j.Moves = append(j.Moves, line.Moves...)
+		j.done = append(j.done, make([]bool, len(line.Moves))...)
+		if line.Done != nil && 0 <= *line.Done && *line.Done < len(j.done) {
+			j.done[*line.Done] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+
+	j.path = path
+	j.file = file
+	j.resumed = true
+	return j, nil
+}
+
+// sameJournal はfileがまだpathにあるジャーナルかどうかを確認する。削除されていればos.ErrNotExistを返す
+func sameJournal(file *os.File, path string) error {
+	opened, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat journal: %w", err)
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat journal: %w", err)
+	}
+	if !os.SameFile(opened, current) {
+		return fmt.Errorf("journal %s: %w", path, os.ErrNotExist)
+	}
+	return nil
+}
+
+// Pending は未完了のMoveの番号を返す
+func (j *RenameJournal) Pending() []int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	resp := make([]int, 0, len(j.done))
+	for i, done := range j.done {
+		if !done {
+			resp = append(resp, i)
+		}
+	}
+	return resp
+}
+
+func (j *RenameJournal) all() []int {
+	resp := make([]int, 0, len(j.Moves))
+	for i := range j.Moves {
+		resp = append(resp, i)
+	}
+	return resp
+}
+
+// add はジャーナルに無いMoveを追加して記録する
+func (j *RenameJournal) add(moves []Move) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	known := make(map[[4]string]bool, len(j.Moves))
+	for _, m := range j.Moves {
+		known[m.route()] = true
+	}
+	added := make([]Move, 0)
+	for _, m := range moves {
+		if !known[m.route()] {
+			known[m.route()] = true
+			added = append(added, m)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	j.Moves = append(j.Moves, added...)
+	j.done = append(j.done, make([]bool, len(added))...)
+	return j.append(journalLine{Moves: added})
+}
+
+// Done はi番目のMoveが完了したことを記録する
+func (j *RenameJournal) Done(i int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.done[i] = true
+	return j.append(journalLine{Done: &i})
+}
+
+// Close はジャーナルを残したままファイルを閉じてロックを解放する。リトライか再起動時の復旧で読み込み直す
+func (j *RenameJournal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	if err != nil {
+		return fmt.Errorf("close journal: %w", err)
+	}
+	return nil
+}
+
+// Remove はリネームが完了した、もしくはロールバックしたジャーナルを削除する。
+// ロックを解放する前に削除し、他の復旧が完了済みのジャーナルを読み込まないようにする
+func (j *RenameJournal) Remove() error {
+	if j.path == "" {
+		return nil
+	}
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove journal: %w", err)
+	}
+	return j.Close()
+}
+
+func (j *RenameJournal) append(v any) error {
+	if j.file == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal journal: %w", err)
+	}
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("sync journal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package fs
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRenameJournal(t *testing.T) {
+	dir := t.TempDir()
+	source, dest := Parse("bucket/aaa"), Parse("bucket/bbb")
+	moves := DirMoves([]S3Object{{Key: "aaa/"}, {Key: "aaa/111"}, {Key: "aaa/222"}}, source, dest)
+
+	j, err := OpenRenameJournal(dir, "http://localhost:4566", source, dest, moves)
+	if err != nil {
+		t.Fatalf("OpenRenameJournal() error = %v", err)
+	}
+	if j.resumed {
+		t.Errorf("OpenRenameJournal() resumed = true, want false")
+	}
+	if err := j.Done(1); err != nil {
+		t.Fatalf("Done() error = %v", err)
+	}
+
+	// 使用中のジャーナルはロックされているため、復旧では読み込まず、同じリネームも開始できない
+	if journals, err := LoadRenameJournals(dir); err != nil || len(journals) != 0 {
+		t.Fatalf("LoadRenameJournals() while locked = %v, %v, want none", journals, err)
+	}
+	if _, err := OpenRenameJournal(dir, "http://localhost:4566", source, dest, nil); !errors.Is(err, errJournalLocked) {
+		t.Fatalf("OpenRenameJournal() while locked error = %v, want %v", err, errJournalLocked)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	journals, err := LoadRenameJournals(dir)
+	if err != nil {
+		t.Fatalf("LoadRenameJournals() error = %v", err)
+	}
+	if len(journals) != 1 {
+		t.Fatalf("LoadRenameJournals() len = %v, want 1", len(journals))
+	}
+	if got := journals[0]; !reflect.DeepEqual(got.Moves, moves) || !reflect.DeepEqual(got.Pending(), []int{0, 2}) {
+		t.Errorf("LoadRenameJournals() = %v %v, want %v [0 2]", got.Moves, got.Pending(), moves)
+	}
+	if err := journals[0].Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	retry, err := OpenRenameJournal(dir, "http://localhost:4566", source, dest, nil)
+	if err != nil {
+		t.Fatalf("OpenRenameJournal() retry error = %v", err)
+	}
+	if !retry.resumed || !reflect.DeepEqual(retry.Moves, moves) {
+		t.Errorf("OpenRenameJournal() retry = %v %v, want resumed %v", retry.resumed, retry.Moves, moves)
+	}
+
+	if err := retry.Remove(); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if journals, _ := LoadRenameJournals(dir); len(journals) != 0 {
+		t.Errorf("LoadRenameJournals() after Remove len = %v, want 0", len(journals))
+	}
+}
+
+func TestRenameJournal_retry(t *testing.T) {
+	dir := t.TempDir()
+	endpoint := "http://localhost:4566"
+	source, dest := Parse("bucket/aaa"), Parse("bucket/bbb")
+	moves := DirMoves([]S3Object{{Key: "aaa/111"}, {Key: "aaa/222"}}, source, dest)
+
+	j, err := OpenRenameJournal(dir, endpoint, source, dest, moves)
+	if err != nil {
+		t.Fatalf("OpenRenameJournal() error = %v", err)
+	}
+	if err := j.Done(0); err != nil {
+		t.Fatalf("Done() error = %v", err)
+	}
+	// 失敗したリネームはジャーナルを残してファイルだけ閉じる
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// 別のエンドポイントの同じリネームは別のジャーナルになる
+	other, err := OpenRenameJournal(dir, "http://localhost:4567", source, dest, moves)
+	if err != nil {
+		t.Fatalf("OpenRenameJournal() other endpoint error = %v", err)
+	}
+	if other.resumed {
+		t.Errorf("OpenRenameJournal() other endpoint resumed = true, want false")
+	}
+	if err := other.Remove(); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+
+	// リトライ時に増えていたオブジェクトのMoveを追加する
+	retryMoves := DirMoves([]S3Object{{Key: "aaa/222"}, {Key: "aaa/333"}}, source, dest)
+	retry, err := OpenRenameJournal(dir, endpoint, source, dest, retryMoves)
+	if err != nil {
+		t.Fatalf("OpenRenameJournal() retry error = %v", err)
+	}
+	want := append(moves, retryMoves[1])
+	if !retry.resumed || !reflect.DeepEqual(retry.Moves, want) || !reflect.DeepEqual(retry.Pending(), []int{1, 2}) {
+		t.Errorf("OpenRenameJournal() retry = %v %v %v, want resumed %v [1 2]", retry.resumed, retry.Moves, retry.Pending(), want)
+	}
+	if err := retry.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	journals, err := LoadRenameJournals(dir)
+	if err != nil {
+		t.Fatalf("LoadRenameJournals() error = %v", err)
+	}
+	if len(journals) != 1 || journals[0].Endpoint != endpoint || !reflect.DeepEqual(journals[0].Moves, want) {
+		t.Fatalf("LoadRenameJournals() = %+v, want one journal with %v", journals, want)
+	}
+	if err := journals[0].Remove(); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package fs
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// s3fs, goofysと同じキーでPOSIXの属性をユーザメタデータ(x-amz-meta-*)に保存する
+// https://github.com/s3fs-fuse/s3fs-fuse/wiki/Fuse-Over-Amazon
+const (
+	metaMode  = "mode"
+	metaUID   = "uid"
+	metaGID   = "gid"
+	metaMtime = "mtime"
+	metaAtime = "atime"
+
+	// シンボリックリンクのリンク先
+	metaSymlinkTarget = "symlink-target"
+)
+
+// internalMetaKeys はファイルシステムが管理するユーザメタデータ。拡張属性からは見せず、書き換えさせない
+var internalMetaKeys = []string{metaMode, metaUID, metaGID, metaMtime, metaAtime, metaSymlinkTarget}
+
+// isInternalMeta はkeyがファイルシステムが管理するユーザメタデータかを大文字小文字を区別せずに返す
+func isInternalMeta(key string) bool {
+	for _, v := range internalMetaKeys {
+		if strings.EqualFold(key, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// metaValue はユーザメタデータを大文字小文字を区別せずに取得する。SDKはキーを Mode のように正規化して返すため
+func metaValue(metadata map[string]*string, key string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v, true
+		}
+	}
+	return "", false
+}
+
+// escapeMeta はUS-ASCIIしか保存できないユーザメタデータのため、制御文字、非ASCII文字と '%' をパーセントエンコードする
+func escapeMeta(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c < 0x20 || c >= 0x7f || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// symlinkTarget はシンボリックリンクのリンク先をデコードして返す。デコードできない値はそのまま返す
+func symlinkTarget(metadata map[string]*string) (string, bool) {
+	v, ok := metaValue(metadata, metaSymlinkTarget)
+	if !ok {
+		return "", false
+	}
+	if target, err := url.PathUnescape(v); err == nil {
+		return target, true
+	}
+	return v, true
+}
+
+func metaUint32(metadata map[string]*string, key string) (uint32, bool) {
+	v, ok := metaValue(metadata, key)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// metaTime はUNIX時間(秒、小数点以下はナノ秒)で保存された時刻を取得する
+func metaTime(metadata map[string]*string, key string) (*time.Time, bool) {
+	v, ok := metaValue(metadata, key)
+	if !ok {
+		return nil, false
+	}
+
+	sec, nsec, _ := strings.Cut(v, ".")
+	s, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	var ns int64
+	if nsec != "" {
+		ns, err = strconv.ParseInt((nsec + "000000000")[:9], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+	}
+	return timePtr(time.Unix(s, ns)), true
+}
+
+func formatMetaTime(t time.Time) string {
+	if t.Nanosecond() == 0 {
+		return strconv.FormatInt(t.Unix(), 10) // s3fsと同じ秒単位の表現
+	}
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+// mergeMeta はmetadataにupdateを上書きした新しいマップを返す。updateの値が空の場合はキーを削除する
+func mergeMeta(metadata map[string]*string, update map[string]string) map[string]*string {
+	resp := make(map[string]*string, len(metadata)+len(update))
+	for k, v := range metadata {
+		resp[strings.ToLower(k)] = v
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(resp, strings.ToLower(k))
+			continue
+		}
+		resp[strings.ToLower(k)] = aws.String(v)
+	}
+	return resp
+}
+
+// posixMeta は作成時のモードと所有者をメタデータに変換する
+func posixMeta(mode uint32, owner fuse.Owner) map[string]*string {
+	return map[string]*string{
+		metaMode: aws.String(strconv.FormatUint(uint64(mode), 10)),
+		metaUID:  aws.String(strconv.FormatUint(uint64(owner.Uid), 10)),
+		metaGID:  aws.String(strconv.FormatUint(uint64(owner.Gid), 10)),
+	}
+}
+
+// timesMeta はUtimensで指定された時刻をメタデータに変換する。nilの時刻は変更しない
+func timesMeta(atime, mtime *time.Time) map[string]string {
+	resp := map[string]string{}
+	if atime != nil {
+		resp[metaAtime] = formatMetaTime(*atime)
+	}
+	if mtime != nil {
+		resp[metaMtime] = formatMetaTime(*mtime)
+	}
+	return resp
+}
+
+// applyTimes はメタデータに保存された時刻をattrに反映する。
+// LastModifiedは内容とメタデータのどちらの変更でも更新されるため、ctimeとして扱う
+func applyTimes(attr *fuse.Attr, lastModified *time.Time, metadata map[string]*string) {
+	mtime := lastModified
+	if t, ok := metaTime(metadata, metaMtime); ok {
+		mtime = t
+	}
+	atime := mtime
+	if t, ok := metaTime(metadata, metaAtime); ok {
+		atime = t
+	}
+	attr.SetTimes(atime, mtime, lastModified)
+}
+
+// applyMeta はメタデータに保存されたパーミッションと所有者をattrに反映する。ファイル種別はS3上の状態を優先する
+func applyMeta(attr *fuse.Attr, metadata map[string]*string) {
+	if mode, ok := metaUint32(metadata, metaMode); ok {
+		attr.Mode = attr.Mode&syscall.S_IFMT | mode&07777
+	}
+	if uid, ok := metaUint32(metadata, metaUID); ok {
+		attr.Owner.Uid = uid
+	}
+	if gid, ok := metaUint32(metadata, metaGID); ok {
+		attr.Owner.Gid = gid
+	}
+}
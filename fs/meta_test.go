@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"testing"
+	"time"
+)
+
+func TestApplyMeta(t *testing.T) {
+	type args struct {
+		attr     fuse.Attr
+		metadata map[string]*string
+	}
+	tests := []struct {
+		name string
+		args args
+		want fuse.Attr
+	}{
+		{
+			name: "no metadata",
+			args: args{
+				attr:     fuse.Attr{Mode: fuse.S_IFREG | 0777},
+				metadata: map[string]*string{},
+			},
+			want: fuse.Attr{Mode: fuse.S_IFREG | 0777},
+		},
+		{
+			name: "s3fs style metadata",
+			args: args{
+				attr: fuse.Attr{Mode: fuse.S_IFREG | 0777},
+				metadata: map[string]*string{
+					"Mode": aws.String("33261"), // 0100755
+					"Uid":  aws.String("1000"),
+					"Gid":  aws.String("1001"),
+				},
+			},
+			want: fuse.Attr{Mode: fuse.S_IFREG | 0755, Owner: fuse.Owner{Uid: 1000, Gid: 1001}},
+		},
+		{
+			name: "file type is not overwritten",
+			args: args{
+				attr:     fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+				metadata: map[string]*string{"mode": aws.String("33188")}, // 0100644
+			},
+			want: fuse.Attr{Mode: fuse.S_IFDIR | 0644},
+		},
+		{
+			name: "invalid value is ignored",
+			args: args{
+				attr:     fuse.Attr{Mode: fuse.S_IFREG | 0777},
+				metadata: map[string]*string{"mode": aws.String("rwx")},
+			},
+			want: fuse.Attr{Mode: fuse.S_IFREG | 0777},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.args.attr
+			applyMeta(&got, tt.args.metadata)
+			if got != tt.want {
+				t.Errorf("applyMeta() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetaTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Time
+		wantOk bool
+	}{
+		{
+			name:   "seconds",
+			value:  "1577934245",
+			want:   time.Unix(1577934245, 0),
+			wantOk: true,
+		},
+		{
+			name:   "with nanoseconds",
+			value:  "1577934245.500000000",
+			want:   time.Unix(1577934245, 500000000),
+			wantOk: true,
+		},
+		{
+			name:   "invalid",
+			value:  "2020-01-02",
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := metaTime(map[string]*string{"Mtime": aws.String(tt.value)}, metaMtime)
+			if ok != tt.wantOk {
+				t.Fatalf("metaTime() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && !got.Equal(tt.want) {
+				t.Errorf("metaTime() = %v, want %v", got, tt.want)
+			}
+			if ok && formatMetaTime(*got) != tt.value {
+				t.Errorf("formatMetaTime() = %v, want %v", formatMetaTime(*got), tt.value)
+			}
+		})
+	}
+}
+
+func TestSymlinkTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		escaped string
+	}{
+		{name: "ascii", target: "../dir/file.txt", escaped: "../dir/file.txt"},
+		{name: "non ascii", target: "データ/ファイル", escaped: "%E3%83%87%E3%83%BC%E3%82%BF/%E3%83%95%E3%82%A1%E3%82%A4%E3%83%AB"},
+		{name: "percent and space", target: "a%20b c+d", escaped: "a%2520b c+d"},
+		{name: "control character", target: "a\nb", escaped: "a%0Ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			escaped := escapeMeta(tt.target)
+			if escaped != tt.escaped {
+				t.Errorf("escapeMeta() = %q, want %q", escaped, tt.escaped)
+			}
+			got, ok := symlinkTarget(map[string]*string{"Symlink-Target": aws.String(escaped)})
+			if !ok || got != tt.target {
+				t.Errorf("symlinkTarget() = %q, %v, want %q", got, ok, tt.target)
+			}
+		})
+	}
+}
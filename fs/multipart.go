@@ -0,0 +1,123 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"log"
+)
+
+// S3のマルチパートアップロードは最終パート以外、5MiB以上である必要がある
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/qfacts.html
+const minPartSize = 5 << 20
+
+type MultipartUpload struct {
+	sess *S3Session
+
+	bucket   string
+	key      string
+	uploadID string
+
+	parts []*s3.CompletedPart
+}
+
+// NewMultipartUpload はマルチパートアップロードを開始する。headはContent-Typeの推測に使うオブジェクトの先頭部分。
+// preserveがfalseの場合は既存のオブジェクトのContent-Typeを引き継がない
+func (s *S3Session) NewMultipartUpload(bucket, key string, metadata map[string]*string, head []byte, preserve bool) (*MultipartUpload, error) {
+	return s.createMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		Metadata:    metadata,
+		ContentType: s.contentType(bucket, key, head, preserve),
+	})
+}
+
+func (s *S3Session) createMultipartUpload(input *s3.CreateMultipartUploadInput) (*MultipartUpload, error) {
+	out, err := s.svc.CreateMultipartUpload(input)
+	if err != nil {
+		return nil, fmt.Errorf("create multipart upload: %w", err)
+	}
+
+	return &MultipartUpload{
+		sess:     s,
+		bucket:   *input.Bucket,
+		key:      *input.Key,
+		uploadID: *out.UploadId,
+	}, nil
+}
+
+func (u *MultipartUpload) UploadPart(body []byte) error {
+	partNumber := int64(len(u.parts) + 1)
+	log.Println("upload part:", u.key, partNumber, len(body))
+
+	out, err := u.sess.svc.UploadPart(&s3.UploadPartInput{
+		Bucket:     &u.bucket,
+		Key:        &u.key,
+		UploadId:   &u.uploadID,
+		PartNumber: &partNumber,
+		Body:       bytes.NewReader(body),
+	})
+	if err != nil {
+		return fmt.Errorf("upload part %d: %w", partNumber, err)
+	}
+
+	u.parts = append(u.parts, &s3.CompletedPart{
+		ETag:       out.ETag,
+		PartNumber: aws.Int64(partNumber),
+	})
+	return nil
+}
+
+// UploadPartCopy はコピー元オブジェクトのstartからendバイト目(endを含む)をサーバサイドでパートとしてコピーする
+func (u *MultipartUpload) UploadPartCopy(sourceBucket, sourceKey string, start, end int64) error {
+	partNumber := int64(len(u.parts) + 1)
+	log.Println("upload part copy:", sourceKey, "->", u.key, partNumber, start, end)
+
+	out, err := u.sess.svc.UploadPartCopy(&s3.UploadPartCopyInput{
+		Bucket:          &u.bucket,
+		Key:             &u.key,
+		UploadId:        &u.uploadID,
+		PartNumber:      &partNumber,
+		CopySource:      aws.String(copySource(sourceBucket, sourceKey)),
+		CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	})
+	if err != nil {
+		return fmt.Errorf("upload part copy %d: %w", partNumber, err)
+	}
+
+	u.parts = append(u.parts, &s3.CompletedPart{
+		ETag:       out.CopyPartResult.ETag,
+		PartNumber: aws.Int64(partNumber),
+	})
+	return nil
+}
+
+func (u *MultipartUpload) Complete() error {
+	u.sess.invalidate(u.bucket, u.key)
+
+	_, err := u.sess.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   &u.bucket,
+		Key:      &u.key,
+		UploadId: &u.uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: u.parts,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (u *MultipartUpload) Abort() error {
+	_, err := u.sess.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &u.bucket,
+		Key:      &u.key,
+		UploadId: &u.uploadID,
+	})
+	if err != nil {
+		return fmt.Errorf("abort multipart upload: %w", err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"fmt"
 	"golang.org/x/exp/slices"
 	"path"
 	"path/filepath"
@@ -72,6 +73,50 @@ func Parse(name string) Position {
 	}
 }
 
+// Root はマウントルートにするバケットとprefix。Bucketが空の場合はバケットの一覧をマウントルートにする
+type Root struct {
+	Bucket string
+	Prefix string
+}
+
+// ParseRoot は bucket[:prefix] 形式のマウント元を解釈する
+func ParseRoot(s string) (Root, error) {
+	bucket, prefix, _ := strings.Cut(s, ":")
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return Root{}, fmt.Errorf("invalid mount root %q: expected bucket[:prefix]", s)
+	}
+
+	prefix = strings.Trim(path.Clean("/"+prefix), "/")
+	return Root{Bucket: bucket, Prefix: prefix}, nil
+}
+
+// Parse はマウントルートからのパスを解釈する。バケットを指定している場合、マウントルートはprefixを指し、prefixの外には出られない
+func (r Root) Parse(name string) Position {
+	if r.Bucket == "" {
+		return Parse(name)
+	}
+
+	// ".."でprefixの外に出ないように、ルートからの絶対パスとして正規化する
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" {
+		return Position{
+			IsMountRoot:  true,
+			IsBucketRoot: r.Prefix == "",
+			Bucket:       r.Bucket,
+			Key:          r.Prefix,
+			OriginalPath: name,
+		}
+	}
+
+	return Position{
+		IsMountRoot:  false,
+		IsBucketRoot: false,
+		Bucket:       r.Bucket,
+		Key:          path.Join(r.Prefix, rel),
+		OriginalPath: name,
+	}
+}
+
 func CanAccess(list []string, destPath string) bool {
 	destSplit := strings.Split(destPath, string(filepath.Separator))
 	for _, v := range list {
@@ -56,6 +56,87 @@ func TestNextParentPath(t *testing.T) {
 	}
 }
 
+func TestParseRoot(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Root
+		wantErr bool
+	}{
+		{name: "bucket", s: "local-test", want: Root{Bucket: "local-test"}},
+		{name: "prefix", s: "local-test:fixtures", want: Root{Bucket: "local-test", Prefix: "fixtures"}},
+		{name: "slashes", s: "local-test:/fixtures/v1/", want: Root{Bucket: "local-test", Prefix: "fixtures/v1"}},
+		{name: "outside", s: "local-test:../other", want: Root{Bucket: "local-test", Prefix: "other"}},
+		{name: "empty", s: "", wantErr: true},
+		{name: "no bucket", s: ":fixtures", wantErr: true},
+		{name: "bucket with slash", s: "local-test/fixtures", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRoot(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRoot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRoot() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoot_Parse(t *testing.T) {
+	tests := []struct {
+		name string
+		root Root
+		path string
+		want Position
+	}{
+		{
+			name: "all buckets",
+			root: Root{},
+			path: "local-test/a.txt",
+			want: Position{Bucket: "local-test", Key: "a.txt", OriginalPath: "local-test/a.txt"},
+		},
+		{
+			name: "bucket root",
+			root: Root{Bucket: "local-test"},
+			path: "",
+			want: Position{IsMountRoot: true, IsBucketRoot: true, Bucket: "local-test"},
+		},
+		{
+			name: "bucket child",
+			root: Root{Bucket: "local-test"},
+			path: "a/b.txt",
+			want: Position{Bucket: "local-test", Key: "a/b.txt", OriginalPath: "a/b.txt"},
+		},
+		{
+			name: "prefix root",
+			root: Root{Bucket: "local-test", Prefix: "fixtures"},
+			path: ".",
+			want: Position{IsMountRoot: true, Bucket: "local-test", Key: "fixtures", OriginalPath: "."},
+		},
+		{
+			name: "prefix child",
+			root: Root{Bucket: "local-test", Prefix: "fixtures"},
+			path: "a/b.txt",
+			want: Position{Bucket: "local-test", Key: "fixtures/a/b.txt", OriginalPath: "a/b.txt"},
+		},
+		{
+			name: "outside prefix",
+			root: Root{Bucket: "local-test", Prefix: "fixtures"},
+			path: "../other/b.txt",
+			want: Position{Bucket: "local-test", Key: "fixtures/other/b.txt", OriginalPath: "../other/b.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.root.Parse(tt.path); got != tt.want {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestCanAccess(t *testing.T) {
 	type args struct {
 		list     []string
@@ -1,10 +1,31 @@
 package fs
 
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// ディレクトリのリネーム時に並列で移動するオブジェクト数
+const renameConcurrency = 8
+
+// 進捗をログ出力する間隔
+const renameProgressInterval = 100
+
 type Move struct {
 	SourceBucket string
 	SourceKey    string
 	DestBucket   string
 	DestKey      string
+
+	// DestExisted リネーム前から移動先にオブジェクトがあった。ロールバックで削除しない
+	DestExisted bool `json:",omitempty"`
+}
+
+// route は移動元と移動先の組を返す
+func (m Move) route() [4]string {
+	return [4]string{m.SourceBucket, m.SourceKey, m.DestBucket, m.DestKey}
 }
 
 func NewMove(source, dest Position) Move {
@@ -15,3 +36,189 @@ func NewMove(source, dest Position) Move {
 		DestKey:      dest.Key,
 	}
 }
+
+// DirMoves はsourceディレクトリ配下のオブジェクトを、destディレクトリ配下へ移動するMoveに変換する。
+// キーはディレクトリのprefixに完全一致する先頭部分だけを置き換える
+func DirMoves(list []S3Object, source, dest Position) []Move {
+	sourcePrefix := source.Key + "/"
+	destPrefix := dest.Key + "/"
+
+	moves := make([]Move, 0, len(list))
+	for _, v := range list {
+		if !strings.HasPrefix(v.Key, sourcePrefix) {
+			continue
+		}
+		moves = append(moves, Move{
+			SourceBucket: source.Bucket,
+			SourceKey:    v.Key,
+			DestBucket:   dest.Bucket,
+			DestKey:      destPrefix + strings.TrimPrefix(v.Key, sourcePrefix),
+		})
+	}
+	return moves
+}
+
+// 中断されたリネームの復旧方法
+const (
+	// RecoverForward 残りのMoveを実行してリネームを完了させる
+	RecoverForward = "forward"
+
+	// RecoverRollback 完了済みのMoveを元に戻してリネーム前の状態にする
+	RecoverRollback = "rollback"
+)
+
+// renameDir はジャーナルに記録しながらディレクトリ配下のオブジェクトを移動する
+func (f *FileSystem) renameDir(source, dest Position, moves []Move) error {
+	if err := f.markExisting(dest, moves); err != nil {
+		return err
+	}
+	journal, err := OpenRenameJournal(f.opts.JournalDir, f.sess.Endpoint, source, dest, moves)
+	if err != nil {
+		return err
+	}
+
+	move, indices := f.move, journal.Pending()
+	if journal.resumed {
+		// 前回の記録以降に移動済みのものがあるかもしれないため、すべてのMoveをS3の状態を見て再開する
+		log.Printf("resume rename journal: %s -> %s\n", journal.Source, journal.Dest)
+		move, indices = f.resumeMove, journal.all()
+	}
+
+	if err := f.moveAll(journal, indices, move); err != nil {
+		// ジャーナルは残しておき、リトライか再起動時に復旧する
+		if cerr := journal.Close(); cerr != nil {
+			log.Println(cerr)
+		}
+		return err
+	}
+	return journal.Remove()
+}
+
+// markExisting は移動先に既にあるオブジェクトのMoveにDestExistedを付ける
+func (f *FileSystem) markExisting(dest Position, moves []Move) error {
+	list, err := f.sess.ListNoCache(dest.Bucket, dest.Key+"/")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(list))
+	for _, obj := range list {
+		existing[obj.Key] = true
+	}
+	for i := range moves {
+		moves[i].DestExisted = existing[moves[i].DestKey]
+	}
+	return nil
+}
+
+// recoverRenames は前回の起動時に中断されたリネームを、RenameRecoveryの指定に従って完了かロールバックする
+func (f *FileSystem) recoverRenames() error {
+	journals, err := LoadRenameJournals(f.opts.JournalDir)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range journals {
+		if j.Endpoint != "" && j.Endpoint != f.sess.Endpoint {
+			// 別のエンドポイントのマウントが復旧する
+			_ = j.Close()
+			continue
+		}
+		log.Printf("recover rename journal(%s): %s -> %s\n", f.opts.RenameRecovery, j.Source, j.Dest)
+
+		// 各Moveの実行状況はS3上の存在有無で判断するため、どちらの方法でも何度実行しても結果は同じになる
+		if f.opts.RenameRecovery == RecoverRollback {
+			err = f.moveAll(j, j.all(), f.rollbackMove)
+		} else {
+			err = f.moveAll(j, j.all(), f.resumeMove)
+		}
+		if err != nil {
+			return fmt.Errorf("recover rename %s -> %s: %w", j.Source, j.Dest, err)
+		}
+
+		if err := j.Remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeMove はコピー元が残っている場合のみ移動する。コピー元が無ければ前回の実行で移動済み
+func (f *FileSystem) resumeMove(m Move) error {
+	if !f.sess.Exists(m.SourceBucket, m.SourceKey) {
+		return nil
+	}
+	return f.move(m)
+}
+
+// rollbackMove は移動先にコピーされたオブジェクトを元の位置に戻す。
+// リネーム前から移動先にあったオブジェクトは、上書きされていても削除しない
+func (f *FileSystem) rollbackMove(m Move) error {
+	if !f.sess.Exists(m.DestBucket, m.DestKey) {
+		return nil // 未実行
+	}
+	if f.sess.Exists(m.SourceBucket, m.SourceKey) {
+		if m.DestExisted {
+			return nil
+		}
+		// コピーのみ完了していたので、コピー先を削除する
+		return f.sess.Delete(m.DestBucket, m.DestKey)
+	}
+	if m.DestExisted {
+		return f.sess.Copy(m.DestBucket, m.DestKey, m.SourceBucket, m.SourceKey)
+	}
+	return f.move(Move{
+		SourceBucket: m.DestBucket,
+		SourceKey:    m.DestKey,
+		DestBucket:   m.SourceBucket,
+		DestKey:      m.SourceKey,
+	})
+}
+
+// moveAll はジャーナルのindicesで指定されたMoveを並列に実行し、完了したものをジャーナルに記録する
+func (f *FileSystem) moveAll(journal *RenameJournal, indices []int, move func(Move) error) error {
+	ch := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		done     int
+		firstErr error
+	)
+
+	for i := 0; i < renameConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				m := journal.Moves[i]
+				err := move(m)
+				if err == nil {
+					err = journal.Done(i)
+				}
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("move %s to %s: %w", m.SourceKey, m.DestKey, err)
+				}
+				done++
+				if done%renameProgressInterval == 0 || done == len(indices) {
+					log.Printf("rename progress: %d/%d\n", done, len(indices))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, i := range indices {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break // 失敗した場合は残りの移動を行わない
+		}
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDirMoves(t *testing.T) {
+	type args struct {
+		list   []S3Object
+		source Position
+		dest   Position
+	}
+	tests := []struct {
+		name string
+		args args
+		want []Move
+	}{
+		{
+			name: "move folder object and children",
+			args: args{
+				list:   []S3Object{{Key: "aaa/111/"}, {Key: "aaa/111/ccc"}},
+				source: Parse("bucket/aaa/111"),
+				dest:   Parse("bucket/bbb/222"),
+			},
+			want: []Move{
+				{SourceBucket: "bucket", SourceKey: "aaa/111/", DestBucket: "bucket", DestKey: "bbb/222/"},
+				{SourceBucket: "bucket", SourceKey: "aaa/111/ccc", DestBucket: "bucket", DestKey: "bbb/222/ccc"},
+			},
+		},
+		{
+			name: "replace only leading prefix",
+			args: args{
+				list:   []S3Object{{Key: "aaa/x/aaa/ccc"}},
+				source: Parse("bucket/aaa"),
+				dest:   Parse("bucket/bbb"),
+			},
+			want: []Move{
+				{SourceBucket: "bucket", SourceKey: "aaa/x/aaa/ccc", DestBucket: "bucket", DestKey: "bbb/x/aaa/ccc"},
+			},
+		},
+		{
+			name: "skip partial match",
+			args: args{
+				list:   []S3Object{{Key: "aaa/111"}, {Key: "aaab/222"}},
+				source: Parse("bucket/aaa"),
+				dest:   Parse("other/bbb"),
+			},
+			want: []Move{
+				{SourceBucket: "bucket", SourceKey: "aaa/111", DestBucket: "other", DestKey: "bbb/111"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DirMoves(tt.args.list, tt.args.source, tt.args.dest); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DirMoves() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileSystem_rollbackMove(t *testing.T) {
+	tests := []struct {
+		name       string
+		existed    bool
+		sourceGone bool
+		wantSource bool
+		wantDest   bool
+	}{
+		{name: "copied", wantSource: true, wantDest: false},
+		{name: "copied over existing", existed: true, wantSource: true, wantDest: true},
+		{name: "moved", sourceGone: true, wantSource: true, wantDest: false},
+		{name: "moved over existing", existed: true, sourceGone: true, wantSource: true, wantDest: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := newTestSession(t, S3Options{})
+			f := &FileSystem{sess: sess}
+			m := Move{SourceBucket: testBucket, SourceKey: "aaa/111", DestBucket: testBucket, DestKey: "bbb/111", DestExisted: tt.existed}
+
+			// 移動の途中で中断した状態を作る
+			if err := sess.PutBytes(testBucket, m.DestKey, []byte("dest")); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.sourceGone {
+				if err := sess.PutBytes(testBucket, m.SourceKey, []byte("source")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := f.rollbackMove(m); err != nil {
+				t.Fatalf("rollbackMove() error = %v", err)
+			}
+			if got := sess.Exists(testBucket, m.SourceKey); got != tt.wantSource {
+				t.Errorf("source exists = %v, want %v", got, tt.wantSource)
+			}
+			if got := sess.Exists(testBucket, m.DestKey); got != tt.wantDest {
+				t.Errorf("dest exists = %v, want %v", got, tt.wantDest)
+			}
+		})
+	}
+}
+
+func TestFileSystem_recoverRenames(t *testing.T) {
+	sess := newTestSession(t, S3Options{})
+	dir := t.TempDir()
+	f := &FileSystem{sess: sess, opts: Options{JournalDir: dir, RenameRecovery: RecoverForward}}
+
+	// 中断されたリネームと、実行中のリネーム
+	for _, key := range []string{"aaa/111", "ccc/111"} {
+		if err := sess.PutBytes(testBucket, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	interrupted, err := OpenRenameJournal(dir, sess.Endpoint, Parse(testBucket+"/aaa"), Parse(testBucket+"/bbb"),
+		[]Move{NewMove(Parse(testBucket+"/aaa/111"), Parse(testBucket+"/bbb/111"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := interrupted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	running, err := OpenRenameJournal(dir, sess.Endpoint, Parse(testBucket+"/ccc"), Parse(testBucket+"/ddd"),
+		[]Move{NewMove(Parse(testBucket+"/ccc/111"), Parse(testBucket+"/ddd/111"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.Remove()
+
+	if err := f.recoverRenames(); err != nil {
+		t.Fatalf("recoverRenames() error = %v", err)
+	}
+	if !sess.Exists(testBucket, "bbb/111") || sess.Exists(testBucket, "aaa/111") {
+		t.Errorf("recoverRenames() did not complete the interrupted rename")
+	}
+	// ロックされたジャーナルのリネームには触らず、ジャーナルも残す
+	if !sess.Exists(testBucket, "ccc/111") || sess.Exists(testBucket, "ddd/111") {
+		t.Errorf("recoverRenames() moved objects of the running rename")
+	}
+	if _, err := os.Stat(running.path); err != nil {
+		t.Errorf("running journal stat error = %v, want kept", err)
+	}
+	if !reflect.DeepEqual(running.Pending(), []int{0}) {
+		t.Errorf("running journal Pending() = %v, want [0]", running.Pending())
+	}
+}
@@ -2,14 +2,18 @@ package fs
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/patrickmn/go-cache"
 	"io"
 	"log"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -22,17 +26,64 @@ type S3Object struct {
 
 	// Size in bytes of the object
 	Size int64 `type:"integer"`
+
+	// Metadata ユーザメタデータ(x-amz-meta-*)。HeadObjectを行っていない場合はnil
+	Metadata map[string]*string
+
+	// ETag リストとHeadObjectのどちらでも設定される
+	ETag *string
+
+	// 以下はHeadObjectを行った場合のみ設定される
+	ContentType  *string
+	StorageClass *string
+	VersionID    *string
+}
+
+// S3Dir はDelimiter指定でリストした、あるディレクトリ直下の要素
+type S3Dir struct {
+	// CommonPrefixes 末尾スラッシュ付きのキー
+	Prefixes []string
+
+	// Contents
+	Objects []S3Object
 }
 
+const (
+	dirCachePrefix  = "dir:"
+	statCachePrefix = "stat:"
+	// negCachePrefix 存在しなかったキー。エディタやgitが存在しないパスを何度も確認するため
+	negCachePrefix = "neg:"
+)
+
 type S3Session struct {
 	svc *s3.S3
 
 	cache *cache.Cache
 
-	Region string
+	opts S3Options
+
+	Region   string
+	Endpoint string
+}
+
+type S3Options struct {
+	// ContentTypes 拡張子(".js"など)ごとにアップロード時のContent-Typeを上書きする
+	ContentTypes map[string]string
+
+	// PreserveContentType 既存のオブジェクトを上書きする場合は、そのContent-Typeを引き継ぐ
+	PreserveContentType bool
+
+	// CacheTTL キャッシュ期間の既定値
+	CacheTTL CacheTTL
+
+	// BucketCacheTTL バケットごとのキャッシュ期間。書き込みの多いバケットはキャッシュしないなど
+	BucketCacheTTL map[string]CacheTTL
+
+	// BlockCache オブジェクトの内容のディスクキャッシュ。nilの場合は毎回GetObjectする
+	BlockCache *BlockCache
 }
 
-func NewS3Session(region, localStackEndpoint string) *S3Session {
+func NewS3Session(region, localStackEndpoint string, opts S3Options) *S3Session {
 	return &S3Session{
 		svc: s3.New(session.Must(session.NewSession()), &aws.Config{
 			Credentials:      credentials.NewStaticCredentials("test", "test", ""),
@@ -40,8 +91,10 @@ func NewS3Session(region, localStackEndpoint string) *S3Session {
 			Region:           &region,
 			S3ForcePathStyle: aws.Bool(true),
 		}),
-		cache:  cache.New(5*time.Second, 10*time.Second), // TODO 適切な値を決める
-		Region: region,
+		cache:    cache.New(cache.NoExpiration, 10*time.Second), // 期間は登録時にS3Options.CacheTTLから決める
+		opts:     opts,
+		Region:   region,
+		Endpoint: localStackEndpoint,
 	}
 }
 
@@ -62,20 +115,43 @@ func (s *S3Session) ExistsBucket(bucket string) bool {
 		Bucket: &bucket,
 	})
 
-	s.cache.Set(cacheKey("exists-bucket", bucket), err == nil, 1*time.Minute) // 通常バケットは削除されないと思うので長めに取る
+	if err == nil {
+		s.setCache(cacheKey("exists-bucket", bucket), true, s.ttl(bucket).Attr)
+	} else {
+		s.setCache(cacheKey("exists-bucket", bucket), false, s.ttl(bucket).Negative)
+	}
 	return err == nil
 }
 
 func (s *S3Session) Put(bucket, key string, r io.ReadSeeker) error {
-	for _, keyPath := range DirCombination(key) {
-		log.Println(keyPath)
-		s.cache.Delete(cacheKey(bucket, keyPath))
+	return s.PutWithMetadata(bucket, key, r, nil)
+}
+
+func (s *S3Session) PutWithMetadata(bucket, key string, r io.ReadSeeker, metadata map[string]*string) error {
+	return s.putObject(bucket, key, r, metadata, true)
+}
+
+// putObject はオブジェクトをアップロードする。preserveがfalseの場合は既存のオブジェクトのContent-Typeを引き継がない
+func (s *S3Session) putObject(bucket, key string, r io.ReadSeeker, metadata map[string]*string, preserve bool) error {
+	// Content-Typeの推測のために先頭を読み取って戻す
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("read head: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek body: %w", err)
 	}
+	contentType := s.contentType(bucket, key, head[:n], preserve)
 
-	_, err := s.svc.PutObject(&s3.PutObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-		Body:   r,
+	s.invalidate(bucket, key)
+
+	_, err = s.svc.PutObject(&s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		Body:        r,
+		Metadata:    metadata,
+		ContentType: contentType,
 	})
 	if err != nil {
 		return fmt.Errorf("put object: %w", err)
@@ -83,17 +159,137 @@ func (s *S3Session) Put(bucket, key string, r io.ReadSeeker) error {
 	return nil
 }
 
+// contentType はアップロードするオブジェクトのContent-Typeを決める。決められない場合はnilを返し、S3のデフォルトとする。
+// preserveがtrueでkeyのオブジェクトが既にあれば、空のオブジェクトであってもそのContent-Typeを引き継ぐ
+func (s *S3Session) contentType(bucket, key string, head []byte, preserve bool) *string {
+	if s.opts.PreserveContentType && preserve {
+		obj, err := s.Stat(bucket, key)
+		if err != nil {
+			log.Println("stat for content type:", err)
+		}
+		if obj != nil && obj.Key == key && obj.ContentType != nil {
+			return obj.ContentType
+		}
+	}
+
+	if v := DetectContentType(key, head, s.opts.ContentTypes); v != "" {
+		return &v
+	}
+	return nil
+}
+
 func (s *S3Session) PutBytes(bucket, key string, b []byte) error {
 	return s.Put(bucket, key, bytes.NewReader(b))
 }
 
-func (s *S3Session) Get(bucket, key string) ([]byte, error) {
+// Download はオブジェクトをメモリに載せずにwへ書き出す
+func (s *S3Session) Download(bucket, key string, w io.Writer) error {
 	obj, err := s.svc.GetObject(&s3.GetObjectInput{
 		Bucket: &bucket,
 		Key:    &key,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("get object: %w", err)
+		return fmt.Errorf("get object: %w", err)
+	}
+	defer obj.Body.Close()
+
+	if _, err := io.Copy(w, obj.Body); err != nil {
+		return fmt.Errorf("copy obj body: %w", err)
+	}
+	return nil
+}
+
+// GetRange はoffからlengthバイトをRangeヘッダ指定で取得する。オブジェクトの末尾を超える場合は短いか空のスライスを返す
+func (s *S3Session) GetRange(bucket, key string, off, length int64) ([]byte, error) {
+	if length <= 0 {
+		return []byte{}, nil
+	}
+	if s.opts.BlockCache == nil {
+		return s.getRange(bucket, key, off, length, nil)
+	}
+
+	resp, err := s.getRangeCached(bucket, key, off, length)
+	if errors.Is(err, errETagChanged) {
+		// HeadObjectの結果が古かったため、取得し直す
+		s.invalidate(bucket, key)
+		resp, err = s.getRangeCached(bucket, key, off, length)
+	}
+	return resp, err
+}
+
+var errETagChanged = errors.New("etag changed")
+
+// getRangeCached はoffからlengthバイトをブロックキャッシュ経由で取得する。
+// キャッシュはLookupで得たETagで引き、キャッシュに無いブロックはIf-Matchを付けて取得する
+func (s *S3Session) getRangeCached(bucket, key string, off, length int64) ([]byte, error) {
+	obj, err := s.Lookup(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil || obj.Key != key || obj.ETag == nil {
+		return s.getRange(bucket, key, off, length, nil)
+	}
+	if off >= obj.Size {
+		return []byte{}, nil
+	}
+
+	c := s.opts.BlockCache
+	bs := c.BlockSize()
+	end := off + length
+	if end > obj.Size {
+		end = obj.Size
+	}
+
+	resp := make([]byte, 0, end-off)
+	for i := off / bs; i*bs < end; i++ {
+		blockLen := bs
+		if i*bs+blockLen > obj.Size {
+			blockLen = obj.Size - i*bs
+		}
+		block, found := c.Get(bucket, key, *obj.ETag, i, blockLen)
+		if !found {
+			block, err = s.getRange(bucket, key, i*bs, blockLen, obj.ETag)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(block)) != blockLen {
+				return nil, errETagChanged // サイズが変わっている
+			}
+			if err := c.Put(bucket, key, *obj.ETag, i, block); err != nil {
+				log.Println("put block cache:", err)
+			}
+		}
+
+		start := off - i*bs
+		if start < 0 {
+			start = 0
+		}
+		stop := end - i*bs
+		if stop > int64(len(block)) {
+			stop = int64(len(block))
+		}
+		resp = append(resp, block[start:stop]...)
+	}
+	return resp, nil
+}
+
+// getRange はRangeヘッダを指定してGetObjectする。ifMatchを指定した場合、ETagが一致しなければerrETagChangedを返す
+func (s *S3Session) getRange(bucket, key string, off, length int64, ifMatch *string) ([]byte, error) {
+	obj, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket:  &bucket,
+		Key:     &key,
+		Range:   aws.String(fmt.Sprintf("bytes=%d-%d", off, off+length-1)),
+		IfMatch: ifMatch,
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == "InvalidRange" {
+			return []byte{}, nil // offがオブジェクトサイズ以上
+		}
+		if errors.As(err, &aerr) && aerr.Code() == "PreconditionFailed" {
+			return nil, errETagChanged
+		}
+		return nil, fmt.Errorf("get object range: %w", err)
 	}
 	defer obj.Body.Close()
 
@@ -104,30 +300,292 @@ func (s *S3Session) Get(bucket, key string) ([]byte, error) {
 	return body, nil
 }
 
-func (s *S3Session) List(bucket, prefix string) ([]S3Object, error) {
-	if get, found := s.cache.Get(cacheKey(bucket, prefix)); found {
-		return get.([]S3Object), nil
-	}
-
-	objects, err := s.svc.ListObjects(&s3.ListObjectsInput{
+// ListNoCache はキャッシュを使わずにprefixに一致するオブジェクトをすべて返す。リネームのように漏れがあると困る場合に使う
+func (s *S3Session) ListNoCache(bucket, prefix string) ([]S3Object, error) {
+	resp := make([]S3Object, 0)
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
 		Bucket: &bucket,
 		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		resp = append(resp, listedObjects(page)...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list objects v2: %w", err)
+	}
+	return resp, nil
+}
+
+// IsEmptyDir はディレクトリkeyの配下に、フォルダオブジェクト以外のオブジェクトが無いかを返す
+func (s *S3Session) IsEmptyDir(bucket, key string) (bool, error) {
+	dirKey := key + "/"
+	out, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  &bucket,
+		Prefix:  &dirKey,
+		MaxKeys: aws.Int64(2),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("list objects: %w", err)
+		return false, fmt.Errorf("list objects v2: %w", err)
 	}
+	for _, v := range out.Contents {
+		if aws.StringValue(v.Key) != dirKey {
+			return false, nil
+		}
+	}
+	return true, nil
+}
 
-	resp := make([]S3Object, 0, len(objects.Contents))
-	for _, v := range objects.Contents {
-		resp = append(resp, S3Object{
+func listedObjects(page *s3.ListObjectsV2Output) []S3Object {
+	objects := make([]S3Object, 0, len(page.Contents))
+	for _, v := range page.Contents {
+		objects = append(objects, S3Object{
 			Key:          *v.Key,
 			LastModified: v.LastModified,
 			Size:         *v.Size,
+			ETag:         v.ETag,
 		})
 	}
+	return objects
+}
 
-	s.cache.Set(cacheKey(bucket, prefix), resp, cache.DefaultExpiration)
-	return resp, nil
+// DirPages はDelimiterに "/" を指定したリスト結果を、Nextのたびに1ページずつS3から取得する
+type DirPages struct {
+	s      *S3Session
+	bucket string
+	prefix string
+
+	started bool
+	token   *string
+	done    bool
+
+	// all 最後まで読み切った場合にキャッシュする、これまでのページ
+	all *S3Dir
+}
+
+// ListDirPages はprefix直下の1階層分を1ページずつ返すDirPagesを作る。S3へのリクエストはNextを呼ぶまで行わない。
+// 最後まで読み切った場合はキャッシュし、キャッシュがあれば1ページとして返す
+func (s *S3Session) ListDirPages(bucket, prefix string) *DirPages {
+	return &DirPages{s: s, bucket: bucket, prefix: prefix, all: &S3Dir{}}
+}
+
+// Next は次のページを返す。最後まで読み終えた場合はnilを返す
+func (p *DirPages) Next() (*S3Dir, error) {
+	if p.done {
+		return nil, nil
+	}
+	k := cacheKey(dirCachePrefix+p.bucket, strings.TrimSuffix(p.prefix, "/"))
+	if !p.started {
+		p.started = true
+		if get, found := p.s.cache.Get(k); found {
+			p.done = true
+			return get.(*S3Dir), nil
+		}
+	}
+
+	out, err := p.s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:            &p.bucket,
+		Prefix:            &p.prefix,
+		Delimiter:         aws.String("/"),
+		ContinuationToken: p.token,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list objects v2 with delimiter: %w", err)
+	}
+
+	page := &S3Dir{
+		Prefixes: make([]string, 0, len(out.CommonPrefixes)),
+		Objects:  listedObjects(out),
+	}
+	for _, v := range out.CommonPrefixes {
+		page.Prefixes = append(page.Prefixes, *v.Prefix)
+	}
+	p.all.Prefixes = append(p.all.Prefixes, page.Prefixes...)
+	p.all.Objects = append(p.all.Objects, page.Objects...)
+	p.s.cacheStats(p.bucket, p.prefix, page)
+
+	p.token = out.NextContinuationToken
+	if !aws.BoolValue(out.IsTruncated) || p.token == nil {
+		p.done = true
+		p.s.setCache(k, p.all, p.s.ttl(p.bucket).List)
+	}
+	return page, nil
+}
+
+// cacheStats はリスト結果をLookupのキャッシュにも登録し、readdir後のGetAttrでS3へ問い合わせずに済むようにする
+func (s *S3Session) cacheStats(bucket, prefix string, page *S3Dir) {
+	for _, p := range page.Prefixes {
+		// フォルダオブジェクトのLastModifiedを持つキャッシュがあれば、そちらを優先する
+		s.cache.Delete(cacheKey(negCachePrefix+bucket, strings.TrimSuffix(p, "/")))
+		s.addCache(cacheKey(statCachePrefix+bucket, strings.TrimSuffix(p, "/")), &S3Object{Key: p}, s.ttl(bucket).Attr)
+	}
+	for i, obj := range page.Objects {
+		if obj.Key == prefix {
+			continue // ディレクトリ自身のフォルダオブジェクト
+		}
+		s.cache.Delete(cacheKey(negCachePrefix+bucket, strings.TrimSuffix(obj.Key, "/")))
+		s.cacheListed(bucket, &page.Objects[i])
+	}
+}
+
+// cacheListed はリストで得たオブジェクトをLookupのキャッシュに登録する。
+// 変更されていないオブジェクトをHeadObjectで取得したキャッシュがあれば、メタデータを捨てずにそちらの期限を延ばす
+func (s *S3Session) cacheListed(bucket string, obj *S3Object) {
+	k := cacheKey(statCachePrefix+bucket, strings.TrimSuffix(obj.Key, "/"))
+	if get, found := s.cache.Get(k); found {
+		if cached := get.(*S3Object); cached.Metadata != nil && cached.unchanged(obj) {
+			s.setCache(k, cached, s.ttl(bucket).Attr)
+			return
+		}
+	}
+	s.setCache(k, obj, s.ttl(bucket).Attr)
+}
+
+// unchanged はリストで得たobjが同じ内容のオブジェクトかを返す。メタデータだけの更新でもLastModifiedは変わる。
+// HeadObjectのLast-Modifiedは秒単位なので秒で比べる
+func (o *S3Object) unchanged(obj *S3Object) bool {
+	return o.Key == obj.Key && o.Size == obj.Size &&
+		aws.StringValue(o.ETag) == aws.StringValue(obj.ETag) &&
+		o.LastModified != nil && obj.LastModified != nil &&
+		o.LastModified.Truncate(time.Second).Equal(obj.LastModified.Truncate(time.Second))
+}
+
+// Lookup はkeyに一致するファイルかディレクトリを返す。ディレクトリの場合はKeyが末尾スラッシュ付きになる。存在しない場合はnilを返す
+func (s *S3Session) Lookup(bucket, key string) (*S3Object, error) {
+	if get, found := s.cache.Get(cacheKey(statCachePrefix+bucket, key)); found {
+		return get.(*S3Object), nil
+	}
+	if _, found := s.cache.Get(cacheKey(negCachePrefix+bucket, key)); found {
+		return nil, nil
+	}
+
+	obj, err := s.head(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if obj != nil {
+		s.setCache(cacheKey(statCachePrefix+bucket, key), obj, s.ttl(bucket).Attr)
+		return obj, nil
+	}
+
+	// フォルダオブジェクト(末尾スラッシュ)か、配下にオブジェクトを持つprefixであればディレクトリとして扱う
+	dirKey := key + "/"
+	out, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  &bucket,
+		Prefix:  &dirKey,
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list objects v2: %w", err)
+	}
+	if len(out.Contents) == 0 {
+		s.setCache(cacheKey(negCachePrefix+bucket, key), true, s.ttl(bucket).Negative)
+		return nil, nil
+	}
+
+	obj = &S3Object{
+		Key: dirKey,
+	}
+	if *out.Contents[0].Key == dirKey {
+		obj.LastModified = out.Contents[0].LastModified
+	}
+	s.setCache(cacheKey(statCachePrefix+bucket, key), obj, s.ttl(bucket).Attr)
+	return obj, nil
+}
+
+// cached はLookupのキャッシュにあるkeyのオブジェクトを返す。キャッシュに無ければS3へ問い合わせずにnilを返す
+func (s *S3Session) cached(bucket, key string) *S3Object {
+	if get, found := s.cache.Get(cacheKey(statCachePrefix+bucket, strings.TrimSuffix(key, "/"))); found {
+		return get.(*S3Object)
+	}
+	return nil
+}
+
+// Stat はLookupの結果に加えて、ファイルとフォルダオブジェクトのユーザメタデータも返す。
+// リスト結果のキャッシュにはメタデータが無いためHeadObjectを行うので、モードやシンボリックリンクのようにメタデータが必要な場合のみ使う
+func (s *S3Session) Stat(bucket, key string) (*S3Object, error) {
+	obj, err := s.Lookup(bucket, key)
+	if err != nil || obj == nil || obj.Metadata != nil {
+		return obj, err
+	}
+	if strings.HasSuffix(obj.Key, "/") && obj.LastModified == nil {
+		return obj, nil // フォルダオブジェクトを持たないprefixにはメタデータが無い
+	}
+
+	// リスト結果から作られたキャッシュにはメタデータが含まれないため取得し直す
+	headed, err := s.head(bucket, obj.Key)
+	if err != nil || headed == nil {
+		return obj, err
+	}
+	s.setCache(cacheKey(statCachePrefix+bucket, key), headed, s.ttl(bucket).Attr)
+	return headed, nil
+}
+
+func (s *S3Session) head(bucket, key string) (*S3Object, error) {
+	out, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == "NotFound" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("head object: %w", err)
+	}
+
+	metadata := out.Metadata
+	if metadata == nil {
+		metadata = map[string]*string{}
+	}
+	return &S3Object{
+		Key:          key,
+		LastModified: out.LastModified,
+		Size:         aws.Int64Value(out.ContentLength),
+		Metadata:     metadata,
+		ETag:         out.ETag,
+		ContentType:  out.ContentType,
+		StorageClass: out.StorageClass,
+		VersionID:    out.VersionId,
+	}, nil
+}
+
+func (s *S3Session) GetTags(bucket, key string) (map[string]string, error) {
+	out, err := s.svc.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get object tagging: %w", err)
+	}
+
+	tags := make(map[string]string, len(out.TagSet))
+	for _, v := range out.TagSet {
+		tags[aws.StringValue(v.Key)] = aws.StringValue(v.Value)
+	}
+	return tags, nil
+}
+
+// PutTags はオブジェクトのタグをtagsで置き換える
+func (s *S3Session) PutTags(bucket, key string, tags map[string]string) error {
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, &s3.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(v),
+		})
+	}
+
+	_, err := s.svc.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Tagging: &s3.Tagging{
+			TagSet: tagSet,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("put object tagging: %w", err)
+	}
+	return nil
 }
 
 func (s *S3Session) ListBuckets() ([]string, error) {
@@ -145,16 +603,12 @@ func (s *S3Session) ListBuckets() ([]string, error) {
 		bucketNames = append(bucketNames, *v.Name)
 	}
 
-	s.cache.Set(cacheKey("list-buckets", ""), bucketNames, cache.DefaultExpiration)
+	s.setCache(cacheKey("list-buckets", ""), bucketNames, s.opts.CacheTTL.List)
 	return bucketNames, nil
 }
 
 func (s *S3Session) Delete(bucket, key string) error {
-	for _, keyPath := range DirCombination(key) {
-		log.Println(keyPath)
-
-		s.cache.Delete(cacheKey(bucket, keyPath))
-	}
+	s.invalidate(bucket, key)
 
 	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
@@ -166,6 +620,90 @@ func (s *S3Session) Delete(bucket, key string) error {
 	return nil
 }
 
+// CopyObjectの上限。これを超える場合はUploadPartCopyで分割してコピーする。テストで小さくするため変数にしている
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/copy-object.html
+var (
+	maxCopyObjectSize int64 = 5 << 30
+	copyPartSize      int64 = 512 << 20
+)
+
+// Copy はオブジェクトをサーバサイドでコピーする。Content-Typeやユーザメタデータも引き継がれる
+func (s *S3Session) Copy(sourceBucket, sourceKey, destBucket, destKey string) error {
+	return s.copyObject(sourceBucket, sourceKey, destBucket, destKey, nil)
+}
+
+// UpdateMetadata はオブジェクト自身へのコピーで、ユーザメタデータだけを書き換える。valueが空のキーは削除する
+func (s *S3Session) UpdateMetadata(bucket, key string, update map[string]string) error {
+	return s.copyObject(bucket, key, bucket, key, update)
+}
+
+// copyObject は既存のメタデータにupdateをマージしてコピーする
+func (s *S3Session) copyObject(sourceBucket, sourceKey, destBucket, destKey string, update map[string]string) error {
+	head, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &sourceBucket,
+		Key:    &sourceKey,
+	})
+	if err != nil {
+		return fmt.Errorf("head object: %w", err)
+	}
+
+	s.invalidate(destBucket, destKey)
+
+	// コピーによってLastModifiedが更新されるため、mtimeが無ければコピー元のLastModifiedを保存して変わらないようにする
+	metadata := mergeMeta(head.Metadata, update)
+	if _, ok := metaValue(metadata, metaMtime); !ok && head.LastModified != nil {
+		metadata[metaMtime] = aws.String(formatMetaTime(*head.LastModified))
+	}
+
+	if aws.Int64Value(head.ContentLength) <= maxCopyObjectSize {
+		_, err := s.svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:             &destBucket,
+			Key:                &destKey,
+			CopySource:         aws.String(copySource(sourceBucket, sourceKey)),
+			MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+			Metadata:           metadata,
+			CacheControl:       head.CacheControl,
+			ContentDisposition: head.ContentDisposition,
+			ContentEncoding:    head.ContentEncoding,
+			ContentLanguage:    head.ContentLanguage,
+			ContentType:        head.ContentType,
+		})
+		if err != nil {
+			return fmt.Errorf("copy object: %w", err)
+		}
+		return nil
+	}
+
+	upload, err := s.createMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:             &destBucket,
+		Key:                &destKey,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentType:        head.ContentType,
+		Metadata:           metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	size := *head.ContentLength
+	for start := int64(0); start < size; start += copyPartSize {
+		end := start + copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		if err := upload.UploadPartCopy(sourceBucket, sourceKey, start, end); err != nil {
+			if abortErr := upload.Abort(); abortErr != nil {
+				log.Println("abort upload:", abortErr)
+			}
+			return err
+		}
+	}
+	return upload.Complete()
+}
+
 func (s *S3Session) CreateBucket(region, bucket string) error {
 	_, err := s.svc.CreateBucket(&s3.CreateBucketInput{
 		Bucket: &bucket,
@@ -179,7 +717,7 @@ func (s *S3Session) CreateBucket(region, bucket string) error {
 
 	// list-bucketの結果からも削除
 	s.cache.Delete(cacheKey("list-buckets", ""))
-	s.cache.Set(cacheKey("exists-bucket", bucket), true, 1*time.Minute) // 通常バケットは削除されないと思うので長めに取る
+	s.setCache(cacheKey("exists-bucket", bucket), true, s.ttl(bucket).Attr)
 	return nil
 }
 
@@ -193,6 +731,22 @@ func (s *S3Session) DeleteBucket(bucket string) error {
 	return err
 }
 
+// invalidate はkeyの変更によって結果が変わりうるキャッシュを削除する
+func (s *S3Session) invalidate(bucket, key string) {
+	for _, keyPath := range DirCombination(key) {
+		log.Println(keyPath)
+
+		s.cache.Delete(cacheKey(dirCachePrefix+bucket, keyPath))
+		s.cache.Delete(cacheKey(statCachePrefix+bucket, keyPath))
+		s.cache.Delete(cacheKey(negCachePrefix+bucket, keyPath))
+	}
+}
+
+func copySource(bucket, key string) string {
+	escaped := strings.ReplaceAll(url.QueryEscape(key), "+", "%20")
+	return bucket + "/" + strings.ReplaceAll(escaped, "%2F", "/")
+}
+
 func cacheKey(bucket, key string) string {
 	return fmt.Sprintf("%s:%s", bucket, key)
 }
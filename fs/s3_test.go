@@ -0,0 +1,335 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBucket = "example"
+
+// newTestSession はメモリ上のS3に接続したセッションを返す。
+// gofakes3はキー末尾のスラッシュを取り除くため、フォルダオブジェクトは使えない。ディレクトリは配下のオブジェクトで表す
+func newTestSession(t *testing.T, opts S3Options) *S3Session {
+	return newTestSessionWith(t, opts, nil)
+}
+
+// newTestSessionWith はwrapでS3へのリクエストを確認したり失敗させたりできるセッションを返す
+func newTestSessionWith(t *testing.T, opts S3Options, wrap func(http.Handler) http.Handler) *S3Session {
+	t.Helper()
+
+	var h http.Handler = gofakes3.New(s3mem.New()).Server()
+	if wrap != nil {
+		h = wrap(h)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	s := NewS3Session("us-east-1", ts.URL, opts)
+	if err := s.CreateBucket("us-east-1", testBucket); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// getObject はオブジェクトの内容を返す
+func getObject(sess *S3Session, bucket, key string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := sess.Download(bucket, key, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// listDir はprefix直下の一覧を最後のページまで読んで返す
+func listDir(sess *S3Session, bucket, prefix string) (*S3Dir, error) {
+	resp := &S3Dir{}
+	pages := sess.ListDirPages(bucket, prefix)
+	for {
+		page, err := pages.Next()
+		if err != nil {
+			return nil, err
+		}
+		if page == nil {
+			return resp, nil
+		}
+		resp.Prefixes = append(resp.Prefixes, page.Prefixes...)
+		resp.Objects = append(resp.Objects, page.Objects...)
+	}
+}
+
+// requestCounter はS3へのリクエストをメソッドごとに数える
+type requestCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+	// fail trueの間、PUTとPOSTを失敗させる
+	fail bool
+}
+
+func (c *requestCounter) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		if c.counts == nil {
+			c.counts = map[string]int{}
+		}
+		c.counts[requestKind(r)]++
+		fail := c.fail && (r.Method == http.MethodPut || r.Method == http.MethodPost)
+		c.mu.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (c *requestCounter) count(kind string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[kind]
+}
+
+func (c *requestCounter) setFail(fail bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail = fail
+}
+
+// requestKind はリクエストの種類を "GET" や "PUT uploadPart" のように返す
+func requestKind(r *http.Request) string {
+	q := r.URL.Query()
+	switch {
+	case q.Has("partNumber"):
+		return r.Method + " uploadPart"
+	case q.Has("uploads"):
+		return r.Method + " createMultipart"
+	case q.Has("uploadId"):
+		return r.Method + " multipart"
+	}
+	return r.Method
+}
+
+func TestS3Session_StatAfterList(t *testing.T) {
+	c := &requestCounter{}
+	sess := newTestSessionWith(t, S3Options{CacheTTL: CacheTTL{Attr: time.Minute}}, c.wrap)
+	for _, key := range []string{"dir/a.txt", "dir/b.txt"} {
+		if err := sess.PutWithMetadata(testBucket, key, strings.NewReader("hello"), map[string]*string{metaMode: aws.String("644")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	heads := c.count(http.MethodHead)
+
+	// ETagだけが必要な場合はリスト結果で足りる
+	if _, err := listDir(sess, testBucket, "dir/"); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := sess.Lookup(testBucket, "dir/a.txt")
+	if err != nil || obj == nil || obj.ETag == nil {
+		t.Fatalf("Lookup() = %+v, %v, want an ETag", obj, err)
+	}
+	if got := c.count(http.MethodHead) - heads; got != 0 {
+		t.Errorf("HEAD after Lookup = %d, want 0", got)
+	}
+
+	// メタデータが必要な場合は1度だけHeadObjectを行い、リストし直しても結果を使い続ける
+	for i := 0; i < 2; i++ {
+		if _, err := listDir(sess, testBucket, "dir/"); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := sess.Stat(testBucket, "dir/a.txt")
+		if err != nil || obj == nil {
+			t.Fatalf("Stat() = %+v, %v", obj, err)
+		}
+		if v, ok := metaValue(obj.Metadata, metaMode); !ok || v != "644" {
+			t.Errorf("mode = %q, want 644", v)
+		}
+	}
+	if got := c.count(http.MethodHead) - heads; got != 1 {
+		t.Errorf("HEAD after Stat = %d, want 1", got)
+	}
+}
+
+// putManyKeys はListObjectsV2の1ページ(1000件)を超えるオブジェクトをprefix直下に作り、
+// その下の階層にもオブジェクトを置く。直下のキーを返す
+func putManyKeys(t *testing.T, sess *S3Session, prefix string) []string {
+	t.Helper()
+	keys := make([]string, 0, 1001)
+	for i := 0; i < 1001; i++ {
+		key := fmt.Sprintf("%s%04d.txt", prefix, i)
+		if err := sess.PutBytes(testBucket, key, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for _, key := range []string{prefix + "sub/a/1.txt", prefix + "sub/b/2.txt", prefix + "other/3.txt"} {
+		if err := sess.PutBytes(testBucket, key, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func TestS3Session_ListNoCache(t *testing.T) {
+	c := &requestCounter{}
+	sess := newTestSessionWith(t, S3Options{}, c.wrap)
+	putManyKeys(t, sess, "big/")
+	lists := c.count(http.MethodGet)
+
+	got, err := sess.ListNoCache(testBucket, "big/")
+	if err != nil {
+		t.Fatalf("ListNoCache() error = %v", err)
+	}
+	if len(got) != 1004 {
+		t.Errorf("ListNoCache() len = %d, want 1004", len(got))
+	}
+	if got := c.count(http.MethodGet) - lists; got != 2 {
+		t.Errorf("ListObjectsV2 requests = %d, want 2", got)
+	}
+}
+
+func TestS3Session_ListDirPages(t *testing.T) {
+	sess := newTestSession(t, S3Options{})
+	want := putManyKeys(t, sess, "big/")
+
+	pages := sess.ListDirPages(testBucket, "big/")
+	var (
+		n        int
+		keys     []string
+		prefixes []string
+	)
+	for {
+		page, err := pages.Next()
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if page == nil {
+			break
+		}
+		n++
+		prefixes = append(prefixes, page.Prefixes...)
+		for _, obj := range page.Objects {
+			keys = append(keys, obj.Key)
+		}
+	}
+
+	if n < 2 {
+		t.Errorf("pages = %d, want more than 1", n)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("objects len = %d, want %d", len(keys), len(want))
+	}
+	// 1階層だけを返し、sub/a/ のような孫のprefixは含まない
+	sort.Strings(prefixes)
+	if wantPrefixes := []string{"big/other/", "big/sub/"}; !reflect.DeepEqual(prefixes, wantPrefixes) {
+		t.Errorf("prefixes = %v, want %v", prefixes, wantPrefixes)
+	}
+}
+
+// uploadPartCopy はgofakes3が対応していないUploadPartCopyを、コピー元の範囲をGETしてUploadPartすることで再現する
+func uploadPartCopy(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source := r.Header.Get("X-Amz-Copy-Source")
+		if r.Method != http.MethodPut || source == "" || !r.URL.Query().Has("partNumber") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		get := httptest.NewRequest(http.MethodGet, "/"+source, nil)
+		get.Header.Set("Range", r.Header.Get("X-Amz-Copy-Source-Range"))
+		got := httptest.NewRecorder()
+		h.ServeHTTP(got, get)
+		if got.Code != http.StatusPartialContent && got.Code != http.StatusOK {
+			w.WriteHeader(got.Code)
+			return
+		}
+
+		put := httptest.NewRequest(http.MethodPut, r.URL.String(), bytes.NewReader(got.Body.Bytes()))
+		put.Header.Set("Content-Length", strconv.Itoa(got.Body.Len()))
+		part := httptest.NewRecorder()
+		h.ServeHTTP(part, put)
+		if part.Code != http.StatusOK {
+			w.WriteHeader(part.Code)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", part.Header().Get("ETag"))
+	})
+}
+
+func Test_copySource(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{name: "plain", key: "dir/a.txt", want: "bucket/dir/a.txt"},
+		{name: "space", key: "dir/a b.txt", want: "bucket/dir/a%20b.txt"},
+		{name: "plus", key: "dir/a+b.txt", want: "bucket/dir/a%2Bb.txt"},
+		{name: "percent", key: "dir/100%.txt", want: "bucket/dir/100%25.txt"},
+		{name: "non-ASCII", key: "ディレクトリ/日本語.txt", want: "bucket/%E3%83%87%E3%82%A3%E3%83%AC%E3%82%AF%E3%83%88%E3%83%AA/%E6%97%A5%E6%9C%AC%E8%AA%9E.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := copySource("bucket", tt.key); got != tt.want {
+				t.Errorf("copySource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3Session_Copy(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		partCopy  bool
+		wantParts int
+	}{
+		{name: "copy object", size: 5},
+		// CopyObjectの上限を超える場合はUploadPartCopyで分割する
+		{name: "upload part copy", size: minPartSize + 5, partCopy: true, wantParts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.partCopy {
+				maxCopyObjectSize, copyPartSize = minPartSize, minPartSize
+				t.Cleanup(func() { maxCopyObjectSize, copyPartSize = 5<<30, 512<<20 })
+			}
+			c := &requestCounter{}
+			sess := newTestSessionWith(t, S3Options{}, func(h http.Handler) http.Handler {
+				return c.wrap(uploadPartCopy(h))
+			})
+
+			// エスケープが必要な文字を含むキー
+			source, dest := "src/a b+c%d 日本語.txt", "dest/a b+c%d 日本語.txt"
+			want := bytes.Repeat([]byte("x"), tt.size)
+			if err := sess.PutBytes(testBucket, source, want); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := sess.Copy(testBucket, source, testBucket, dest); err != nil {
+				t.Fatalf("Copy() error = %v", err)
+			}
+			got, err := getObject(sess, testBucket, dest)
+			if err != nil {
+				t.Fatalf("getObject() error = %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("copied object len = %d, want %d", len(got), len(want))
+			}
+			if got := c.count("PUT uploadPart"); got != tt.wantParts {
+				t.Errorf("UploadPartCopy requests = %d, want %d", got, tt.wantParts)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package fs
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/s3"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"log"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// 拡張属性とS3のユーザメタデータ、タグの対応
+//
+//	user.s3.meta.<key>  x-amz-meta-<key>。modeなどファイルシステムが使うキーは除く
+//	user.s3.tag.<key>   オブジェクトタグ
+//	user.s3.etag など   HeadObjectの結果(読み取り専用)
+const (
+	xattrMetaPrefix   = "user.s3.meta."
+	xattrTagPrefix    = "user.s3.tag."
+	xattrETag         = "user.s3.etag"
+	xattrContentType  = "user.s3.content-type"
+	xattrStorageClass = "user.s3.storage-class"
+	xattrVersionID    = "user.s3.version-id"
+)
+
+// setxattr(2)のflags
+const (
+	xattrCreate  = 0x1 // XATTR_CREATE
+	xattrReplace = 0x2 // XATTR_REPLACE
+)
+
+var (
+	_ fusefs.NodeGetxattrer    = (*Node)(nil)
+	_ fusefs.NodeListxattrer   = (*Node)(nil)
+	_ fusefs.NodeSetxattrer    = (*Node)(nil)
+	_ fusefs.NodeRemovexattrer = (*Node)(nil)
+)
+
+func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	data, errno := n.fsys.getXAttr(n.fsys.parse(n.name()), attr)
+	if errno != fusefs.OK {
+		return 0, errno
+	}
+	return copyXAttr(dest, data)
+}
+
+func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	attrs, errno := n.fsys.listXAttr(n.fsys.parse(n.name()))
+	if errno != fusefs.OK {
+		return 0, errno
+	}
+
+	// 属性名はNUL区切りで返す
+	var data []byte
+	for _, v := range attrs {
+		data = append(data, v...)
+		data = append(data, 0)
+	}
+	return copyXAttr(dest, data)
+}
+
+func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return n.fsys.setXAttr(n.fsys.parse(n.name()), attr, data, int(flags))
+}
+
+func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return n.fsys.removeXAttr(n.fsys.parse(n.name()), attr)
+}
+
+// copyXAttr はdestに値をコピーする。destが足りない場合は必要なサイズとERANGEを返す
+func copyXAttr(dest, data []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(data) {
+		return uint32(len(data)), syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), fusefs.OK
+}
+
+func (f *FileSystem) getXAttr(pos Position, attribute string) ([]byte, syscall.Errno) {
+	log.Printf("GetXAttr pos:%+v attr:%s\n", pos, attribute)
+
+	if pos.IsMountRoot || pos.IsBucketRoot {
+		return nil, syscall.ENODATA
+	}
+
+	obj, err := f.sess.Stat(pos.Bucket, pos.Key)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	if obj == nil {
+		return nil, syscall.ENOENT
+	}
+
+	switch {
+	case strings.HasPrefix(attribute, xattrMetaPrefix):
+		key := strings.TrimPrefix(attribute, xattrMetaPrefix)
+		if isInternalMeta(key) {
+			break
+		}
+		if v, ok := metaValue(obj.Metadata, key); ok {
+			return []byte(v), fusefs.OK
+		}
+	case strings.HasPrefix(attribute, xattrTagPrefix):
+		if obj.Metadata == nil {
+			break // フォルダオブジェクトを持たないディレクトリ
+		}
+		tags, err := f.sess.GetTags(pos.Bucket, obj.Key)
+		if err != nil {
+			log.Println("get tags:", err)
+			return nil, syscall.EIO
+		}
+		if v, ok := tags[strings.TrimPrefix(attribute, xattrTagPrefix)]; ok {
+			return []byte(v), fusefs.OK
+		}
+	default:
+		if v, ok := readOnlyXAttrs(obj)[attribute]; ok {
+			return []byte(v), fusefs.OK
+		}
+	}
+	return nil, syscall.ENODATA
+}
+
+func (f *FileSystem) listXAttr(pos Position) ([]string, syscall.Errno) {
+	log.Printf("ListXAttr pos:%+v\n", pos)
+
+	if pos.IsMountRoot || pos.IsBucketRoot {
+		return []string{}, fusefs.OK
+	}
+
+	obj, err := f.sess.Stat(pos.Bucket, pos.Key)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	if obj == nil {
+		return nil, syscall.ENOENT
+	}
+	if obj.Metadata == nil {
+		return []string{}, fusefs.OK // フォルダオブジェクトを持たないディレクトリ
+	}
+
+	attrs := make([]string, 0, len(obj.Metadata))
+	for k := range obj.Metadata {
+		if isInternalMeta(k) {
+			continue
+		}
+		attrs = append(attrs, xattrMetaPrefix+strings.ToLower(k))
+	}
+
+	tags, err := f.sess.GetTags(pos.Bucket, obj.Key)
+	if err != nil {
+		log.Println("get tags:", err)
+		return nil, syscall.EIO
+	}
+	for k := range tags {
+		attrs = append(attrs, xattrTagPrefix+k)
+	}
+
+	for k := range readOnlyXAttrs(obj) {
+		attrs = append(attrs, k)
+	}
+	sort.Strings(attrs)
+	return attrs, fusefs.OK
+}
+
+func (f *FileSystem) setXAttr(pos Position, attr string, data []byte, flags int) syscall.Errno {
+	log.Printf("SetXAttr pos:%+v attr:%s\n", pos, attr)
+
+	switch {
+	case strings.HasPrefix(attr, xattrMetaPrefix):
+		key := strings.TrimPrefix(attr, xattrMetaPrefix)
+		if isInternalMeta(key) {
+			return syscall.EPERM // chmodやchownで変更する
+		}
+		if key == "" || len(data) == 0 {
+			return syscall.EINVAL // 空の値はS3に保存できない
+		}
+		return f.updateMeta(pos, func(obj *S3Object) (map[string]string, syscall.Errno) {
+			_, exists := metaValue(obj.Metadata, key)
+			return map[string]string{key: string(data)}, xattrFlags(flags, exists)
+		})
+	case strings.HasPrefix(attr, xattrTagPrefix):
+		key := strings.TrimPrefix(attr, xattrTagPrefix)
+		if key == "" {
+			return syscall.EINVAL
+		}
+		return f.updateTags(pos, func(tags map[string]string) syscall.Errno {
+			_, exists := tags[key]
+			if errno := xattrFlags(flags, exists); errno != fusefs.OK {
+				return errno
+			}
+			tags[key] = string(data)
+			return fusefs.OK
+		})
+	case isReadOnlyXAttr(attr):
+		return syscall.EPERM
+	}
+	return syscall.ENOTSUP
+}
+
+func (f *FileSystem) removeXAttr(pos Position, attr string) syscall.Errno {
+	log.Printf("RemoveXAttr pos:%+v attr:%s\n", pos, attr)
+
+	switch {
+	case strings.HasPrefix(attr, xattrMetaPrefix):
+		key := strings.TrimPrefix(attr, xattrMetaPrefix)
+		if isInternalMeta(key) {
+			return syscall.EPERM
+		}
+		return f.updateMeta(pos, func(obj *S3Object) (map[string]string, syscall.Errno) {
+			if _, ok := metaValue(obj.Metadata, key); !ok {
+				return nil, syscall.ENODATA
+			}
+			return map[string]string{key: ""}, fusefs.OK
+		})
+	case strings.HasPrefix(attr, xattrTagPrefix):
+		key := strings.TrimPrefix(attr, xattrTagPrefix)
+		return f.updateTags(pos, func(tags map[string]string) syscall.Errno {
+			if _, ok := tags[key]; !ok {
+				return syscall.ENODATA
+			}
+			delete(tags, key)
+			return fusefs.OK
+		})
+	case isReadOnlyXAttr(attr):
+		return syscall.EPERM
+	}
+	return syscall.ENOTSUP
+}
+
+// updateTags はオブジェクトのタグを取得し、fnで書き換えたものを保存する
+func (f *FileSystem) updateTags(pos Position, fn func(tags map[string]string) syscall.Errno) syscall.Errno {
+	if pos.IsMountRoot || pos.IsBucketRoot {
+		return syscall.EPERM
+	}
+
+	obj, err := f.sess.Lookup(pos.Bucket, pos.Key)
+	if err != nil {
+		return syscall.EIO
+	}
+	if obj == nil {
+		return syscall.ENOENT
+	}
+	if strings.HasSuffix(obj.Key, "/") && obj.LastModified == nil {
+		return syscall.ENOTSUP // タグを付けるオブジェクトが無い
+	}
+
+	tags, err := f.sess.GetTags(pos.Bucket, obj.Key)
+	if err != nil {
+		log.Println("get tags:", err)
+		return syscall.EIO
+	}
+	if errno := fn(tags); errno != fusefs.OK {
+		return errno
+	}
+	if err := f.sess.PutTags(pos.Bucket, obj.Key, tags); err != nil {
+		log.Println("put tags:", err)
+		return syscall.EIO
+	}
+	return fusefs.OK
+}
+
+// xattrFlags はsetxattrのXATTR_CREATE, XATTR_REPLACEを検査する
+func xattrFlags(flags int, exists bool) syscall.Errno {
+	if flags&xattrCreate != 0 && exists {
+		return syscall.EEXIST
+	}
+	if flags&xattrReplace != 0 && !exists {
+		return syscall.ENODATA
+	}
+	return fusefs.OK
+}
+
+func readOnlyXAttrs(obj *S3Object) map[string]string {
+	resp := make(map[string]string, 4)
+	if obj.ETag != nil {
+		resp[xattrETag] = strings.Trim(*obj.ETag, `"`)
+	}
+	if obj.ContentType != nil {
+		resp[xattrContentType] = *obj.ContentType
+	}
+	if obj.StorageClass != nil {
+		resp[xattrStorageClass] = *obj.StorageClass
+	} else if obj.Metadata != nil {
+		resp[xattrStorageClass] = s3.StorageClassStandard // STANDARDの場合はレスポンスヘッダに含まれない
+	}
+	if obj.VersionID != nil {
+		resp[xattrVersionID] = *obj.VersionID
+	}
+	return resp
+}
+
+func isReadOnlyXAttr(attr string) bool {
+	switch attr {
+	case xattrETag, xattrContentType, xattrStorageClass, xattrVersionID:
+		return true
+	}
+	return false
+}
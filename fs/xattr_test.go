@@ -0,0 +1,57 @@
+package fs
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFileSystem_internalMetaXAttr(t *testing.T) {
+	sess := newTestSession(t, S3Options{})
+	metadata := map[string]*string{metaMode: aws.String("33188"), metaUID: aws.String("1000"), "color": aws.String("red")}
+	if err := sess.PutWithMetadata(testBucket, "a.txt", strings.NewReader("hello"), metadata); err != nil {
+		t.Fatal(err)
+	}
+	f := &FileSystem{sess: sess}
+	pos := Parse(testBucket + "/a.txt")
+
+	attrs, errno := f.listXAttr(pos)
+	if errno != fusefs.OK {
+		t.Fatalf("listXAttr() = %v", errno)
+	}
+	for _, v := range attrs {
+		if v == xattrMetaPrefix+metaMode || v == xattrMetaPrefix+metaUID {
+			t.Errorf("listXAttr() exposes %s", v)
+		}
+	}
+
+	tests := []struct {
+		name string
+		run  func() syscall.Errno
+		want syscall.Errno
+	}{
+		{name: "get mode", run: func() syscall.Errno { _, errno := f.getXAttr(pos, xattrMetaPrefix+"mode"); return errno }, want: syscall.ENODATA},
+		{name: "set mode", run: func() syscall.Errno { return f.setXAttr(pos, xattrMetaPrefix+"mode", []byte("511"), 0) }, want: syscall.EPERM},
+		{name: "set symlink target", run: func() syscall.Errno { return f.setXAttr(pos, xattrMetaPrefix+"Symlink-Target", []byte("/etc"), 0) }, want: syscall.EPERM},
+		{name: "remove uid", run: func() syscall.Errno { return f.removeXAttr(pos, xattrMetaPrefix+"uid") }, want: syscall.EPERM},
+		{name: "get user key", run: func() syscall.Errno { _, errno := f.getXAttr(pos, xattrMetaPrefix+"color"); return errno }, want: fusefs.OK},
+		{name: "set user key", run: func() syscall.Errno { return f.setXAttr(pos, xattrMetaPrefix+"color", []byte("blue"), 0) }, want: fusefs.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.run(); got != tt.want {
+				t.Errorf("errno = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	obj, err := sess.Stat(testBucket, "a.txt")
+	if err != nil || obj == nil {
+		t.Fatalf("Stat() = %v, %v", obj, err)
+	}
+	if v, _ := metaValue(obj.Metadata, metaMode); v != "33188" {
+		t.Errorf("mode = %q, want 33188", v)
+	}
+}
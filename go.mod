@@ -3,16 +3,20 @@ module github.com/ma91n/localstackmount
 go 1.18
 
 require (
-	github.com/aws/aws-sdk-go v1.44.81
-	github.com/hanwen/go-fuse v1.0.0
+	github.com/aws/aws-sdk-go v1.44.256
+	github.com/hanwen/go-fuse/v2 v2.6.3
+	github.com/johannesboyne/gofakes3 v0.0.0-20250402064820-d479899d8cbe
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/spaolacci/murmur3 v1.1.0
 	golang.org/x/exp v0.0.0-20220826144839-4cc3b17fd1f1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	golang.org/x/net v0.0.0-20220526153639-5463443f8c37 // indirect
-	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
+	github.com/ryszard/goskiplist v0.0.0-20150312221310-2dfbae5fcf46 // indirect
+	go.shabbyrobe.org/gocovmerge v0.0.0-20230507111327-fa4f82cfbf4d // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/tools v0.8.0 // indirect
 )
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ma91n/localstackmount/fs"
+	"net/url"
+	"strings"
+)
+
+// helperIgnoredOptions はmount(8)やfstabが付けるオプションのうち、FUSEに渡さずに無視するもの
+var helperIgnoredOptions = map[string]bool{
+	"defaults": true,
+	"rw":       true,
+	"auto":     true,
+	"noauto":   true,
+	"user":     true,
+	"nouser":   true,
+	"users":    true,
+	"_netdev":  true,
+	"nofail":   true,
+	"dev":      true,
+	"suid":     true,
+	"exec":     true,
+	"atime":    true,
+}
+
+// helperMountOptions はFUSEのマウントオプションとしてそのまま渡すもの
+var helperMountOptions = map[string]bool{
+	"ro":         true,
+	"nodev":      true,
+	"nosuid":     true,
+	"noexec":     true,
+	"noatime":    true,
+	"nodiratime": true,
+	"relatime":   true,
+	"sync":       true,
+	"async":      true,
+	"dirsync":    true,
+}
+
+// isHelper はマウントヘルパーの形式の引数かを返す。
+// mount.fuseは "localstackmount <source> <mountpoint> -o opts"、mount(8)は "mount.fuse.localstackmount <source> <mountpoint> -o opts" で呼び出す
+func isHelper(args []string) bool {
+	return len(args) >= 2 && !strings.HasPrefix(args[0], "-") && !strings.HasPrefix(args[1], "-")
+}
+
+// helperArgs はマウントヘルパーの引数をmountサブコマンドのフラグに変換する。
+// -oの各オプションは同名のフラグになり(allow_otherは--allow-other)、foregroundを指定しない限りデーモンとして起動する
+func helperArgs(args []string) ([]string, error) {
+	var positional, options []string
+	for i := 0; i < len(args); i++ {
+		switch v := args[i]; {
+		case v == "-o":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("option -o requires an argument")
+			}
+			i++
+			options = append(options, strings.Split(args[i], ",")...)
+		case strings.HasPrefix(v, "-o"):
+			options = append(options, strings.Split(strings.TrimPrefix(v, "-o"), ",")...)
+		case v == "-t":
+			i++ // ファイルシステムの種類は常にfuse.localstackmount
+		case v == "-n", v == "-s", v == "-v", v == "-f":
+			// mount(8)がヘルパーに渡すフラグ(mtabを書かない、ソートなど)は関係ない
+		case strings.HasPrefix(v, "-"):
+			return nil, fmt.Errorf("unknown option %s", v)
+		default:
+			positional = append(positional, v)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, fmt.Errorf("usage: localstackmount <source> <mountpoint> [-o opt1,opt2]")
+	}
+
+	endpoint, root, err := parseSource(positional[0])
+	if err != nil {
+		return nil, err
+	}
+
+	flags := []string{"--dir=" + positional[1]}
+	if endpoint != "" {
+		flags = append(flags, "--endpoint="+endpoint)
+	}
+	if root != "" {
+		flags = append(flags, "--root="+root)
+	}
+	daemon := true
+	var mountOptions []string
+	for _, o := range options {
+		name, value, hasValue := strings.Cut(o, "=")
+		switch {
+		case name == "":
+		case name == "foreground":
+			daemon = false
+		case helperIgnoredOptions[name], name == "comment", strings.HasPrefix(name, "x-"):
+		case helperMountOptions[name]:
+			mountOptions = append(mountOptions, o)
+		case hasValue:
+			flags = append(flags, "--"+strings.ReplaceAll(name, "_", "-")+"="+value)
+		default:
+			flags = append(flags, "--"+strings.ReplaceAll(name, "_", "-"))
+		}
+	}
+	if len(mountOptions) > 0 {
+		flags = append(flags, "--mount-options="+strings.Join(mountOptions, ","))
+	}
+	return append(flags, fmt.Sprintf("--daemon=%t", daemon)), nil
+}
+
+// parseSource はマウントヘルパーのsourceを解釈し、エンドポイントとマウントルート(bucket[:prefix])を返す。
+//
+//	http://localhost:4566                       すべてのバケット
+//	http://localhost:4566/local-test/fixtures   エンドポイントとバケット、prefix
+//	local-test:fixtures                         バケットとprefix。エンドポイントは-o endpoint=や設定ファイルから決める
+func parseSource(source string) (endpoint, root string, err error) {
+	if !strings.Contains(source, "://") {
+		if _, err := fs.ParseRoot(source); err != nil {
+			return "", "", err
+		}
+		return "", source, nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", "", fmt.Errorf("parse source %s: %w", source, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", "", fmt.Errorf("source must be an endpoint URL such as http://localhost:4566 or bucket[:prefix]: %s", source)
+	}
+
+	if bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/"); bucket != "" {
+		root = bucket
+		if prefix != "" {
+			root += ":" + prefix
+		}
+	}
+	return u.Scheme + "://" + u.Host, root, nil
+}
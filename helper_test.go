@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHelperArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "endpoint only",
+			args: []string{"http://localhost:4566", "/mnt/localstack"},
+			want: []string{"--dir=/mnt/localstack", "--endpoint=http://localhost:4566", "--daemon=true"},
+		},
+		{
+			name: "split -o options",
+			args: []string{"http://localhost:4566", "/mnt/localstack", "-o", "allow_other,attr_cache_ttl=10s,profile=ci"},
+			want: []string{"--dir=/mnt/localstack", "--endpoint=http://localhost:4566", "--allow-other", "--attr-cache-ttl=10s", "--profile=ci", "--daemon=true"},
+		},
+		{
+			name: "-oX form",
+			args: []string{"local-test", "/mnt/fixtures", "-oro,noexec"},
+			want: []string{"--dir=/mnt/fixtures", "--root=local-test", "--mount-options=ro,noexec", "--daemon=true"},
+		},
+		{
+			name: "ignore mount(8) options",
+			args: []string{"-n", "local-test:fixtures", "/mnt/fixtures", "-t", "fuse.localstackmount", "-o", "defaults,rw,_netdev,nofail,x-systemd.automount,comment=test"},
+			want: []string{"--dir=/mnt/fixtures", "--root=local-test:fixtures", "--daemon=true"},
+		},
+		{
+			name: "foreground",
+			args: []string{"http://localhost:4566", "/mnt/localstack", "-o", "foreground"},
+			want: []string{"--dir=/mnt/localstack", "--endpoint=http://localhost:4566", "--daemon=false"},
+		},
+		{
+			name:    "missing -o argument",
+			args:    []string{"http://localhost:4566", "/mnt/localstack", "-o"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"http://localhost:4566", "/mnt/localstack", "-x"},
+			wantErr: true,
+		},
+		{
+			name:    "missing mountpoint",
+			args:    []string{"http://localhost:4566", "-o", "ro"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := helperArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("helperArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("helperArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		source       string
+		wantEndpoint string
+		wantRoot     string
+		wantErr      bool
+	}{
+		{source: "http://localhost:4566", wantEndpoint: "http://localhost:4566"},
+		{source: "https://localstack:4566/", wantEndpoint: "https://localstack:4566"},
+		{source: "http://localhost:4566/local-test", wantEndpoint: "http://localhost:4566", wantRoot: "local-test"},
+		{source: "http://localhost:4566/local-test/fixtures/2024", wantEndpoint: "http://localhost:4566", wantRoot: "local-test:fixtures/2024"},
+		{source: "local-test", wantRoot: "local-test"},
+		{source: "local-test:fixtures", wantRoot: "local-test:fixtures"},
+		{source: "ftp://localhost:4566", wantErr: true},
+		{source: "http:///local-test", wantErr: true},
+		{source: ":fixtures", wantErr: true},
+		{source: "local-test/fixtures", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			endpoint, root, err := parseSource(tt.source)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if endpoint != tt.wantEndpoint || root != tt.wantRoot {
+				t.Errorf("parseSource() = %q, %q, want %q, %q", endpoint, root, tt.wantEndpoint, tt.wantRoot)
+			}
+		})
+	}
+}
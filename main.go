@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/ma91n/localstackmount/fs"
 	"golang.org/x/exp/slices"
 	"io"
@@ -16,99 +18,304 @@ import (
 	"path"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 const localStackEndpoint = "http://localhost:4566"
 
 type Input struct {
-	Region             string
-	LocalStackEndpoint string
-	Dir                string
-	Debug              bool
+	Region             string `yaml:"region"`
+	LocalStackEndpoint string `yaml:"endpoint"`
+	// Root bucket[:prefix] 形式で指定したバケットやprefixをマウントルートにする。空の場合はバケットの一覧をマウントルートにする
+	Root               string `yaml:"root"`
+	Dir                string `yaml:"dir"`
+	Debug              bool   `yaml:"debug"`
+	ReadAhead          int64  `yaml:"read_ahead"`
+	MultipartThreshold int64  `yaml:"multipart_threshold"`
+	PartSize           int64  `yaml:"part_size"`
+	JournalDir         string `yaml:"journal_dir"`
+	RenameRecovery     string `yaml:"rename_recovery"`
+
+	// ContentTypes 拡張子ごとのContent-Typeの上書き
+	ContentTypes        map[string]string `yaml:"content_types"`
+	PreserveContentType bool              `yaml:"preserve_content_type"`
+
+	// キャッシュ期間。0の場合はキャッシュしない
+	ListCacheTTL     time.Duration `yaml:"list_cache_ttl"`
+	AttrCacheTTL     time.Duration `yaml:"attr_cache_ttl"`
+	NegativeCacheTTL time.Duration `yaml:"negative_cache_ttl"`
+	// BucketCacheTTL バケットごとのキャッシュ期間の上書き
+	BucketCacheTTL map[string]fs.CacheTTL `yaml:"bucket_cache_ttl"`
+
+	// BlockCacheDir オブジェクトの内容をキャッシュするディレクトリ。空の場合はキャッシュしない
+	BlockCacheDir  string `yaml:"block_cache_dir"`
+	BlockSize      int64  `yaml:"block_size"`
+	BlockCacheSize int64  `yaml:"block_cache_size"`
+
+	// カーネルがエントリ、属性、存在しないことをキャッシュする期間
+	EntryTimeout    time.Duration `yaml:"entry_timeout"`
+	AttrTimeout     time.Duration `yaml:"attr_timeout"`
+	NegativeTimeout time.Duration `yaml:"negative_timeout"`
+	// Owner 指定した場合、所有者が設定されていない(uid, gidが0の)ファイルの所有者をこの値にする
+	Owner *fuse.Owner `yaml:"owner"`
+	// KeepCache ETagが変わっていなければカーネルのページキャッシュを使う
+	KeepCache bool `yaml:"keep_cache"`
+	// ClientInodes ファイルシステムが割り当てたinode番号を使う。falseの場合はgo-fuseが採番する
+	ClientInodes bool `yaml:"client_inodes"`
+
+	// FUSEのマウントオプション
+	AllowOther bool `yaml:"allow_other"`
+	NonEmpty   bool `yaml:"nonempty"`
+	// MountOptions そのままFUSEに渡すマウントオプション(ro, noexecなど)
+	MountOptions []string `yaml:"mount_options"`
+
+	// Daemon バックグラウンドで実行し、マウントが完了してから終了する
+	Daemon bool `yaml:"daemon"`
+	// ReadyFD マウントが完了したら"READY=1"、失敗したら"ERROR=<理由>"を書き込んで閉じるファイルディスクリプタ。0の場合は書き込まない
+	ReadyFD int `yaml:"-"`
 }
 
 func main() {
+	if err := run(os.Args[0], os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func defaultInput() Input {
 	dir, _ := os.UserHomeDir()
 
-	c := Input{
+	return Input{
 		Region:             endpoints.ApNortheast1RegionID,
 		LocalStackEndpoint: localStackEndpoint,
 		Dir:                path.Join(dir, "mount", "localstack"),
 		Debug:              false,
+		ReadAhead:          1 << 20,  // 1MiB
+		MultipartThreshold: 16 << 20, // 16MiB
+		PartSize:           8 << 20,  // 8MiB
+		JournalDir:         path.Join(cacheDir(), "localstackmount", "journal"),
+		RenameRecovery:     fs.RecoverForward,
+		ListCacheTTL:       5 * time.Second,
+		AttrCacheTTL:       5 * time.Second,
+		NegativeCacheTTL:   5 * time.Second,
+		BlockCacheDir:      path.Join(cacheDir(), "localstackmount", "blocks"),
+		BlockSize:          1 << 20, // 1MiB
+		BlockCacheSize:     1 << 30, // 1GiB
+		EntryTimeout:       time.Second,
+		AttrTimeout:        time.Second,
+		NegativeTimeout:    0,
+		KeepCache:          true,
+		ClientInodes:       true,
+		AllowOther:         true,
+		NonEmpty:           true,
 	}
+}
 
-	if os.Getenv("AWS_REGION") != "" {
-		c.Region = os.Getenv("AWS_REGION")
-	}
-
-	if os.Getenv("LOCALSTACK_ENDPOINT") != "" {
-		c.LocalStackEndpoint = os.Getenv("LOCALSTACK_ENDPOINT")
-	}
-
-	if err := mount(c); err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
+func cacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return os.TempDir()
 	}
+	return dir
 }
 
-func mount(c Input) error {
+func mount(c Input) (err error) {
+	n := newNotifier(c.ReadyFD)
+	defer func() {
+		if err != nil {
+			n.Fail(err)
+		}
+	}()
 
 	// create mount point dir
 	_ = os.MkdirAll(c.Dir, 0777)
 
+	abs, _ := filepath.Abs(c.Dir)
+	if st, found, err := findState(abs); err != nil {
+		return err
+	} else if found {
+		return fmt.Errorf("%s is already mounted by pid %d", abs, st.PID)
+	}
+
+	var root fs.Root
+	if c.Root != "" {
+		if root, err = fs.ParseRoot(c.Root); err != nil {
+			return err
+		}
+	}
+
 	if err := doHealthCheck(c.LocalStackEndpoint); err != nil {
 		return err
 	}
 
-	sess := fs.NewS3Session(c.Region, c.LocalStackEndpoint)
+	var blockCache *fs.BlockCache
+	if c.BlockCacheDir != "" {
+		var err error
+		blockCache, err = fs.OpenBlockCache(c.BlockCacheDir, c.BlockSize, c.BlockCacheSize)
+		if err != nil {
+			return err
+		}
+	}
 
-	fileSystem := fs.NewFileSystem(sess)
+	sess := fs.NewS3Session(c.Region, c.LocalStackEndpoint, fs.S3Options{
+		ContentTypes:        c.ContentTypes,
+		PreserveContentType: c.PreserveContentType,
+		CacheTTL: fs.CacheTTL{
+			List:     c.ListCacheTTL,
+			Attr:     c.AttrCacheTTL,
+			Negative: c.NegativeCacheTTL,
+		},
+		BucketCacheTTL: c.BucketCacheTTL,
+		BlockCache:     blockCache,
+	})
+	if root.Bucket != "" && !sess.ExistsBucket(root.Bucket) {
+		return fmt.Errorf("bucket %s does not exist", root.Bucket)
+	}
+
+	fileSystem := fs.NewFileSystem(sess, fs.Options{
+		ReadAhead:          c.ReadAhead,
+		MultipartThreshold: c.MultipartThreshold,
+		PartSize:           c.PartSize,
+		JournalDir:         c.JournalDir,
+		RenameRecovery:     c.RenameRecovery,
+		KeepCache:          c.KeepCache,
+		ClientInodes:       c.ClientInodes,
+		Root:               root,
+	})
 
-	opts := &nodefs.Options{
-		Debug: c.Debug,
+	opts := &fusefs.Options{
+		EntryTimeout:    &c.EntryTimeout,
+		AttrTimeout:     &c.AttrTimeout,
+		NegativeTimeout: &c.NegativeTimeout,
+		RootStableAttr:  &fusefs.StableAttr{Ino: fs.RootIno},
+	}
+	opts.Debug = c.Debug
+	opts.AllowOther = c.AllowOther
+	// readdirplusではエントリごとにLookupされ、lsだけで一覧のオブジェクト数だけHeadObjectすることになる。
+	// statが必要な場合のみLookupさせる
+	opts.DisableReadDirPlus = true
+	if c.NonEmpty {
+		opts.Options = append(opts.Options, "nonempty")
+	}
+	opts.Options = append(opts.Options, c.MountOptions...)
+	if c.Owner != nil {
+		opts.UID, opts.GID = c.Owner.Uid, c.Owner.Gid
 	}
-	s, _, err := mountRoot(c.Dir, fileSystem.Root(), opts)
+	s, err := mountRoot(c.Dir, fileSystem, opts)
 	if err != nil {
-		return fmt.Errorf("nodefs mount root: %w", err)
+		return fmt.Errorf("mount root: %w", err)
 	}
-	defer s.Unmount()
 
 	// ctrl + C
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	detached := make(chan struct{})
 	go func() {
-		for {
-			<-ch
-			err := s.Unmount()
-			if err == nil {
-				log.Println("unmounted")
-				break
+		for range ch {
+			n.Stopping()
+			if err := s.Unmount(); err != nil {
+				if !mounted(abs) {
+					// unmount --forceで遅延解除された。開いたままのファイルを待たずに、書き込みをアップロードして終了する
+					log.Println("mount is detached, flushing open files")
+					if err := fileSystem.FlushAll(); err != nil {
+						log.Println(err)
+					}
+					close(detached)
+					return
+				}
+				// 使用中の場合は次のシグナルかunmountサブコマンドを待つ
+				log.Printf("unmount failed: %v. close the files in use or run `localstackmount unmount --lazy %s`\n", err, abs)
+				continue
 			}
-			fmt.Println("May be in use by another user")
-			fmt.Print("unmount failed: ", err)
+			log.Println("unmounted")
+			return
 		}
 	}()
-	abs, _ := filepath.Abs(c.Dir)
+
+	go s.Serve()
+	if err := s.WaitMount(); err != nil {
+		if err := s.Unmount(); err != nil {
+			log.Println("unmount:", err)
+		}
+		return fmt.Errorf("wait mount: %w", err)
+	}
+
+	// statusで表示するため、マウントできてから状態を書き出す。
+	// 完了を通知された親やsystemdがすぐにstatusを実行しても見つかるように、通知より前に書き込む
+	st := State{
+		PID:        os.Getpid(),
+		Region:     c.Region,
+		Endpoint:   c.LocalStackEndpoint,
+		Root:       c.Root,
+		Mountpoint: abs,
+		Started:    time.Now(),
+	}
+	st.Updated = st.Started
+	st.Cache = sess.CacheStats()
+	if err := writeState(st); err != nil {
+		if err := s.Unmount(); err != nil {
+			log.Println("unmount:", err)
+		}
+		return fmt.Errorf("write state: %w", err)
+	}
 	fmt.Println("mount start:", abs)
+	if err := n.Ready(); err != nil {
+		// 起動した側はマウントに失敗したとみなすため、ステートを残さずにアンマウントする
+		removeState(abs)
+		if err := s.Unmount(); err != nil {
+			log.Println("unmount:", err)
+		}
+		return fmt.Errorf("notify ready: %w", err)
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+		removeState(abs)
+	}()
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(stateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			st.Updated = time.Now()
+			st.Cache = sess.CacheStats()
+			if err := writeState(st); err != nil {
+				log.Println("write state:", err)
+			}
+		}
+	}()
 
-	s.Serve()
+	served := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-detached:
+	}
 	return nil
 }
 
-func mountRoot(mountpoint string, root nodefs.Node, opts *nodefs.Options) (*fuse.Server, *nodefs.FileSystemConnector, error) {
-	conn := nodefs.NewFileSystemConnector(root, opts)
+func mountRoot(mountpoint string, root fusefs.InodeEmbedder, opts *fusefs.Options) (*fuse.Server, error) {
+	opts.FsName = "localstackmount"
+	opts.Name = "localstackmount"
 
-	mountOpts := fuse.MountOptions{
-		AllowOther: true, // TODO コマンドライン引数から取得
-	}
-	mountOpts.Options = append(mountOpts.Options, "nonempty") // TODO
-	if opts != nil && opts.Debug {
-		mountOpts.Debug = opts.Debug
-	}
-	s, err := fuse.NewServer(conn.RawFS(), mountpoint, &mountOpts)
+	s, err := fuse.NewServer(fusefs.NewNodeFS(root, opts), mountpoint, &opts.MountOptions)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return s, conn, nil
+	return s, nil
 }
 
 type Health struct {
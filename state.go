@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ma91n/localstackmount/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stateInterval はステートファイルのキャッシュ統計を更新する間隔
+const stateInterval = 5 * time.Second
+
+// State はマウント中のプロセスの情報。マウントポイントごとにステートファイルに保存し、statusとunmountが参照する
+type State struct {
+	PID        int           `json:"pid"`
+	Region     string        `json:"region"`
+	Endpoint   string        `json:"endpoint"`
+	Root       string        `json:"root,omitempty"`
+	Mountpoint string        `json:"mountpoint"`
+	Started    time.Time     `json:"started"`
+	Updated    time.Time     `json:"updated"`
+	Cache      fs.CacheStats `json:"cache"`
+}
+
+// alive はマウントしたプロセスが動いているかを返す
+func (st State) alive() bool {
+	err := syscall.Kill(st.PID, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func stateDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "localstackmount")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("localstackmount-%d", os.Getuid()))
+}
+
+func statePath(mountpoint string) string {
+	sum := sha256.Sum256([]byte(mountpoint))
+	return filepath.Join(stateDir(), hex.EncodeToString(sum[:8])+".json")
+}
+
+// logPath はデーモンとして起動した場合のログファイル
+func logPath(mountpoint string) string {
+	return strings.TrimSuffix(statePath(mountpoint), ".json") + ".log"
+}
+
+// writeState はステートファイルを書き込む。読み込み中のstatusが壊れたファイルを読まないように一時ファイルからリネームする
+func writeState(st State) error {
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(stateDir(), ".state")
+	if err != nil {
+		return fmt.Errorf("create temp state: %w", err)
+	}
+	if _, err := temp.Write(b); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return fmt.Errorf("write state: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("close state: %w", err)
+	}
+	if err := os.Rename(temp.Name(), statePath(st.Mountpoint)); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("rename state: %w", err)
+	}
+	return nil
+}
+
+func removeState(mountpoint string) {
+	_ = os.Remove(statePath(mountpoint))
+}
+
+// readStates はマウント中のステートを返す。プロセスが終了しているステートファイルは削除する
+func readStates() ([]State, error) {
+	entries, err := os.ReadDir(stateDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state dir: %w", err)
+	}
+
+	var states []State
+	for _, v := range entries {
+		if !strings.HasSuffix(v.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(stateDir(), v.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read state: %w", err)
+		}
+		var st State
+		if err := json.Unmarshal(b, &st); err != nil {
+			return nil, fmt.Errorf("parse state %s: %w", path, err)
+		}
+		if !st.alive() {
+			_ = os.Remove(path) // killされた場合などに残ったファイル
+			continue
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+// findState はマウントポイントのステートを返す
+func findState(mountpoint string) (State, bool, error) {
+	states, err := readStates()
+	if err != nil {
+		return State{}, false, err
+	}
+	for _, st := range states {
+		if st.Mountpoint == mountpoint {
+			return st, true, nil
+		}
+	}
+	return State{}, false, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// exitedPID は終了して回収済みのプロセスのPIDを返す
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestReadStates(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	alive := State{PID: os.Getpid(), Mountpoint: "/mnt/alive", Started: time.Now()}
+	dead := State{PID: exitedPID(t), Mountpoint: "/mnt/dead", Started: time.Now()}
+	for _, st := range []State{alive, dead} {
+		if err := writeState(st); err != nil {
+			t.Fatalf("writeState() error = %v", err)
+		}
+	}
+	// 書き込み途中の一時ファイルは読まない
+	if err := os.WriteFile(filepath.Join(stateDir(), ".state123"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := readStates()
+	if err != nil {
+		t.Fatalf("readStates() error = %v", err)
+	}
+	if len(states) != 1 || states[0].Mountpoint != alive.Mountpoint || states[0].PID != alive.PID {
+		t.Errorf("readStates() = %+v, want only %s", states, alive.Mountpoint)
+	}
+	// 終了したプロセスのステートファイルは削除する
+	if _, err := os.Stat(statePath(dead.Mountpoint)); !os.IsNotExist(err) {
+		t.Errorf("state of the exited process stat error = %v, want not exist", err)
+	}
+
+	tests := []struct {
+		mountpoint string
+		wantFound  bool
+	}{
+		{mountpoint: alive.Mountpoint, wantFound: true},
+		{mountpoint: dead.Mountpoint, wantFound: false},
+		{mountpoint: "/mnt/unknown", wantFound: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mountpoint, func(t *testing.T) {
+			st, found, err := findState(tt.mountpoint)
+			if err != nil {
+				t.Fatalf("findState() error = %v", err)
+			}
+			if found != tt.wantFound || (found && st.PID != alive.PID) {
+				t.Errorf("findState() = %+v, %v, want found %v", st, found, tt.wantFound)
+			}
+		})
+	}
+
+	removeState(alive.Mountpoint)
+	if states, err := readStates(); err != nil || len(states) != 0 {
+		t.Errorf("readStates() after removeState = %+v, %v, want none", states, err)
+	}
+}
+
+func TestReadStates_noDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(t.TempDir(), "missing"))
+
+	states, err := readStates()
+	if err != nil || len(states) != 0 {
+		t.Errorf("readStates() = %+v, %v, want none", states, err)
+	}
+}
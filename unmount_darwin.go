@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// mntForce はmacOSのMNT_FORCE。syscallパッケージには定義されていない
+const mntForce = 0x80000
+
+// unmountDir はマウントを解除する。macOSには遅延解除が無い
+func unmountDir(mountpoint string, lazy, force bool) error {
+	if lazy && !force {
+		return errors.New("lazy unmount is not supported on macOS, use --force")
+	}
+	flags := 0
+	if force {
+		flags |= mntForce
+	}
+	if err := syscall.Unmount(mountpoint, flags); err != nil {
+		return fmt.Errorf("umount: %w", err)
+	}
+	return nil
+}
+
+// mounted はmountpointが今もマウントされているかを返す。macOSには遅延解除が無いため常にtrue
+func mounted(mountpoint string) bool {
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// unmountDir はマウントを解除する。lazyは使用中のファイルが閉じられるまで解除を遅らせ、forceはFUSEの接続を切断する。
+// root以外はumount(2)を呼べないためfusermountを使う
+func unmountDir(mountpoint string, lazy, force bool) error {
+	if os.Geteuid() == 0 {
+		flags := 0
+		if lazy || force {
+			// MNT_FORCEはFUSEの接続を切断し書き込みを失うため使わない。遅延解除した上でプロセスを終了させる
+			flags |= syscall.MNT_DETACH
+		}
+		if err := syscall.Unmount(mountpoint, flags); err != nil {
+			return fmt.Errorf("umount: %w", err)
+		}
+		return nil
+	}
+
+	bin, err := exec.LookPath("fusermount3")
+	if err != nil {
+		bin, err = exec.LookPath("fusermount")
+		if err != nil {
+			return fmt.Errorf("fusermount is not found: %w", err)
+		}
+	}
+	args := []string{"-u"}
+	if lazy || force {
+		args = append(args, "-z") // fusermountには強制解除が無いため、遅延解除した上でプロセスを終了させる
+	}
+	out, err := exec.Command(bin, append(args, mountpoint)...).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "busy") {
+			return fmt.Errorf("%s: %s: %w", bin, strings.TrimSpace(string(out)), syscall.EBUSY)
+		}
+		return fmt.Errorf("%s: %s: %w", bin, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// mounted はmountpointが今もマウントされているかを/proc/self/mountinfoから調べる。遅延解除されたマウントは含まれない
+func mounted(mountpoint string) bool {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return true // 分からない場合はマウントされているものとして扱う
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && unescapeMountinfo(fields[4]) == mountpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeMountinfo は空白などが \040 のように8進数でエスケープされたパスを戻す
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}